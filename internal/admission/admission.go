@@ -0,0 +1,217 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/filelock"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+)
+
+var ErrNotAdmitted = errors.New("not enough host resources to start the VM")
+
+const defaultPollInterval = 5 * time.Second
+
+type Options struct {
+	// MaxCPU and MaxMemory (in megabytes) limit the total amount
+	// of resources reserved by the VMs on the host, zero means
+	// no limit
+	MaxCPU    uint64
+	MaxMemory uint64
+
+	// Wait is how long to wait for the resources to be released
+	// by the other jobs before failing, zero means failing right away
+	Wait time.Duration
+
+	// PollInterval defaults to 5 seconds
+	PollInterval time.Duration
+}
+
+func (opts Options) Enabled() bool {
+	return opts.MaxCPU != 0 || opts.MaxMemory != 0
+}
+
+// Reservation is the amount of resources used by a VM.
+type Reservation struct {
+	CPU       uint64    `json:"cpu"`
+	Memory    uint64    `json:"memory"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Admit reserves the resources used by the VM before it's started, waiting
+// for the other VMs on the host to release them if they don't fit into the
+// limits. The reservation is kept until Release() is called or the VM is deleted.
+func Admit(ctx context.Context, backend tart.Backend, name string, opts Options) error {
+	if !opts.Enabled() {
+		return nil
+	}
+
+	vmInfo, err := backend.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if (opts.MaxCPU != 0 && vmInfo.CPU > opts.MaxCPU) || (opts.MaxMemory != 0 && vmInfo.Memory > opts.MaxMemory) {
+		return fmt.Errorf("%w: VM %s needs %d CPUs and %d MB of memory, which exceeds the limit "+
+			"of %d CPUs and %d MB of memory", ErrNotAdmitted, name, vmInfo.CPU, vmInfo.Memory,
+			opts.MaxCPU, opts.MaxMemory)
+	}
+
+	pollInterval := opts.PollInterval
+	if pollInterval == 0 {
+		pollInterval = defaultPollInterval
+	}
+
+	deadline := time.Now().Add(opts.Wait)
+	waiting := false
+
+	for {
+		var reservedCPU, reservedMemory uint64
+
+		admitted := false
+
+		err := withState(ctx, backend, func(state map[string]Reservation) error {
+			for otherName, reservation := range state {
+				if otherName == name {
+					continue
+				}
+
+				reservedCPU += reservation.CPU
+				reservedMemory += reservation.Memory
+			}
+
+			if (opts.MaxCPU != 0 && reservedCPU+vmInfo.CPU > opts.MaxCPU) ||
+				(opts.MaxMemory != 0 && reservedMemory+vmInfo.Memory > opts.MaxMemory) {
+				return nil
+			}
+
+			state[name] = Reservation{
+				CPU:       vmInfo.CPU,
+				Memory:    vmInfo.Memory,
+				CreatedAt: time.Now(),
+			}
+			admitted = true
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if admitted {
+			return nil
+		}
+
+		if time.Now().Add(pollInterval).After(deadline) {
+			return fmt.Errorf("%w: VM %s needs %d CPUs and %d MB of memory, but the other VMs already "+
+				"reserve %d out of %d CPUs and %d out of %d MB of memory", ErrNotAdmitted, name,
+				vmInfo.CPU, vmInfo.Memory, reservedCPU, opts.MaxCPU, reservedMemory, opts.MaxMemory)
+		}
+
+		if !waiting {
+			log.Printf("Waiting for %d CPUs and %d MB of memory to be released by the other VMs "+
+				"(%d out of %d CPUs and %d out of %d MB of memory are reserved)...\n", vmInfo.CPU,
+				vmInfo.Memory, reservedCPU, opts.MaxCPU, reservedMemory, opts.MaxMemory)
+
+			waiting = true
+		}
+
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release frees the resources reserved by the VM, if any.
+func Release(ctx context.Context, backend tart.Backend, name string) error {
+	return withState(ctx, backend, func(state map[string]Reservation) error {
+		delete(state, name)
+
+		return nil
+	})
+}
+
+// Handover renames the VM using the provided function and moves its reservation,
+// if any, to the new name, e.g. when the warm pool VM is claimed by the job.
+func Handover(ctx context.Context, backend tart.Backend, name string, newName string, rename func() error) error {
+	return withState(ctx, backend, func(state map[string]Reservation) error {
+		if err := rename(); err != nil {
+			return err
+		}
+
+		if reservation, ok := state[name]; ok {
+			delete(state, name)
+			state[newName] = reservation
+		}
+
+		return nil
+	})
+}
+
+// withState provides a consistent view of the reservations, where the
+// reservations of the VMs that no longer exist (e.g. due to the "cleanup"
+// stage not being run) are already removed.
+func withState(ctx context.Context, backend tart.Backend, fn func(state map[string]Reservation) error) error {
+	path, err := statedir.Path("admission.json")
+	if err != nil {
+		return err
+	}
+
+	lock, err := filelock.Lock(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	state := map[string]Reservation{}
+
+	stateBytes, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(stateBytes, &state); err != nil {
+			return err
+		}
+	}
+
+	if len(state) != 0 {
+		listEntries, err := backend.List(ctx)
+		if err != nil {
+			return err
+		}
+
+		existing := map[string]struct{}{}
+
+		for _, listEntry := range listEntries {
+			if listEntry.Source == "local" {
+				existing[listEntry.Name] = struct{}{}
+			}
+		}
+
+		for name := range state {
+			if _, ok := existing[name]; !ok {
+				delete(state, name)
+			}
+		}
+	}
+
+	if err := fn(state); err != nil {
+		return err
+	}
+
+	stateBytes, err = json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, stateBytes, 0600)
+}
@@ -0,0 +1,68 @@
+package admission_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/admission"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"github.com/stretchr/testify/require"
+)
+
+func newVM(t *testing.T, backend *tart.FakeBackend, name string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	require.NoError(t, backend.Clone(ctx, nil, "ghcr.io/cirruslabs/macos-sonoma-base:latest", name,
+		tart.PullOptions{}))
+	require.NoError(t, backend.Set(ctx, name, tart.SetOptions{CPU: 4, Memory: 8192}))
+}
+
+func TestAdmit(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+	opts := admission.Options{MaxCPU: 6, MaxMemory: 16384}
+
+	newVM(t, backend, "gitlab-1")
+	newVM(t, backend, "gitlab-2")
+	newVM(t, backend, "gitlab-3")
+
+	require.NoError(t, admission.Admit(ctx, backend, "gitlab-1", opts))
+
+	// Doesn't fit into the CPU limit
+	require.ErrorIs(t, admission.Admit(ctx, backend, "gitlab-2", opts), admission.ErrNotAdmitted)
+
+	// Fits once the resources are released
+	require.NoError(t, admission.Release(ctx, backend, "gitlab-1"))
+	require.NoError(t, admission.Admit(ctx, backend, "gitlab-2", opts))
+
+	// Waits for the resources to be released, which also
+	// happens when the VM is deleted without the cleanup
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = backend.Delete(ctx, "gitlab-2")
+	}()
+
+	opts.Wait = 10 * time.Second
+	opts.PollInterval = 10 * time.Millisecond
+	require.NoError(t, admission.Admit(ctx, backend, "gitlab-3", opts))
+}
+
+func TestAdmitExceedsLimits(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	backend := tart.NewFakeBackend()
+
+	newVM(t, backend, "gitlab-1")
+
+	// Would never fit, so there's no point in waiting
+	require.ErrorIs(t, admission.Admit(context.Background(), backend, "gitlab-1", admission.Options{
+		MaxMemory: 4096,
+		Wait:      time.Hour,
+	}), admission.ErrNotAdmitted)
+}
@@ -1,7 +1,14 @@
 package cleanup
 
 import (
+	"context"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/admission"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/eventlog"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/gc"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/gitlab"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/metrics"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/pool"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/reuse"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
 	"github.com/spf13/cobra"
 	"log"
@@ -13,7 +20,12 @@ func NewCommand() *cobra.Command {
 		Use:   "cleanup",
 		Short: "Cleanup Tart VM after job finishes",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if err := cleanupVM(cmd, args); err != nil {
+			err := cleanupVM(cmd, args)
+
+			eventlog.Finish(err)
+			metrics.Flush()
+
+			if err != nil {
 				return gitlab.NewSystemFailureError(err)
 			}
 
@@ -30,18 +42,43 @@ func cleanupVM(_ *cobra.Command, _ []string) error {
 		return err
 	}
 
-	vm := tart.ExistingVM(*gitLabEnv)
+	eventlog.SetJob(gitLabEnv.JobID, gitLabEnv.JobImage)
+
+	vm := tart.ExistingVM(tart.DefaultBackend, *gitLabEnv)
 
 	if err = vm.Stop(); err != nil {
 		log.Printf("Failed to stop VM: %v", err)
 	}
 
-	if err := vm.Delete(); err != nil {
+	if err := admission.Release(context.Background(), tart.DefaultBackend, vm.Name()); err != nil {
+		log.Printf("Failed to release the resources reserved by the VM: %v", err)
+	}
+
+	// Failing to find the lease shouldn't leak the VM and the host
+	// directory, so fall back to deleting the VM and report it later
+	reuseLease, reuseErr := reuse.Find(gitLabEnv.JobID)
+	if reuseErr != nil {
+		log.Printf("Failed to find the lease on the kept VM, deleting the VM instead: %v", reuseErr)
+	}
+
+	if reuseLease != nil {
+		keepVM(vm, reuseLease)
+	} else if err := vm.Delete(); err != nil {
 		log.Printf("Failed to delete VM: %v", err)
 
 		return err
 	}
 
+	if err := gc.ForgetJob(gitLabEnv.JobID); err != nil {
+		log.Printf("Failed to forget the job: %v", err)
+	}
+
+	// Ask the warm pool daemon (if any) to replenish the pool
+	// now that the resources occupied by this VM are released
+	if err := pool.Notify(); err != nil {
+		log.Printf("Failed to notify the warm pool: %v", err)
+	}
+
 	tartConfig, err := tart.NewConfigFromEnvironment()
 	if err != nil {
 		return err
@@ -56,5 +93,27 @@ func cleanupVM(_ *cobra.Command, _ []string) error {
 		}
 	}
 
-	return nil
+	return reuseErr
+}
+
+// keepVM keeps the VM for the subsequent jobs of the same project,
+// falling back to deleting it if that's not possible.
+func keepVM(vm *tart.VM, reuseLease *reuse.Lease) {
+	if err := vm.Rename(context.Background(), reuseLease.VMName); err != nil {
+		log.Printf("Failed to keep VM for the subsequent jobs: %v", err)
+
+		if err := vm.Delete(); err != nil {
+			log.Printf("Failed to delete VM: %v", err)
+		}
+
+		if err := reuseLease.Discard(); err != nil {
+			log.Printf("Failed to discard the kept VM: %v", err)
+		}
+
+		return
+	}
+
+	if err := reuseLease.Release(); err != nil {
+		log.Printf("Failed to release the kept VM: %v", err)
+	}
 }
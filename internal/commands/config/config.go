@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/gitlab"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/imagealias"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/version"
 	"github.com/spf13/cobra"
@@ -52,6 +53,8 @@ func NewCommand() *cobra.Command {
 		"path to a directory in guest to use for caching purposes, useful when mounting a block device "+
 			"via \"--disk\" command-line argument (mutually exclusive with \"--cache-dir\")")
 
+	imagealias.IntroduceFlag(cmd)
+
 	return cmd
 }
 
@@ -113,6 +116,13 @@ func runConfig(_ *cobra.Command, _ []string) error {
 			ErrConfigFailed)
 	}
 
+	// Let the subsequent stages and the job know which image the alias resolved to
+	if image, ok, err := imagealias.Resolve(gitLabEnv.JobImage); err != nil {
+		return err
+	} else if ok {
+		gitlabRunnerConfig.JobEnv[imagealias.EnvResolvedImage] = image
+	}
+
 	// Figure out the builds directory override to use
 	switch {
 	case tartConfig.HostDir:
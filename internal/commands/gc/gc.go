@@ -0,0 +1,264 @@
+package gc
+
+import (
+	"context"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/gc"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/pool"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/reuse"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"github.com/spf13/cobra"
+)
+
+var minAge time.Duration
+var dryRun bool
+var tmpDirs []string
+var jobStatusURL string
+var jobStatusToken string
+var reuseMaxJobs uint
+var reuseMaxAge time.Duration
+
+func NewCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "gc",
+		Short: "Delete the job VMs, host directories and VM leases left behind when \"cleanup\" stage didn't run",
+		RunE:  runGC,
+	}
+
+	command.PersistentFlags().DurationVar(&minAge, "min-age", time.Hour,
+		"only consider the VMs and host directories that were not accessed for at least this long")
+	command.PersistentFlags().BoolVar(&dryRun, "dry-run", false,
+		"only print what would be deleted")
+	command.PersistentFlags().StringArrayVar(&tmpDirs, "tmp-dir", []string{os.TempDir()},
+		"temporary directory to look for the host directories (see TART_EXECUTOR_HOST_DIR) in, "+
+			"can be specified multiple times")
+	command.PersistentFlags().StringVar(&jobStatusURL, "job-status-url", "",
+		"URL of the GitLab's \"Get a single job\" API endpoint (or a compatible one) with \"{project_id}\" "+
+			"and \"{job_id}\" placeholders to find the running VMs of the finished jobs, e.g. "+
+			"\"https://gitlab.example.com/api/v4/projects/{project_id}/jobs/{job_id}\"")
+	command.PersistentFlags().StringVar(&jobStatusToken, "job-status-token", "",
+		"token to pass in the PRIVATE-TOKEN header when querying the --job-status-url")
+	command.PersistentFlags().UintVar(&reuseMaxJobs, "reuse-max-jobs", 0,
+		"delete the kept VMs that have run this many jobs, same as for \"prepare\" (0 means no limit)")
+	command.PersistentFlags().DurationVar(&reuseMaxAge, "reuse-max-age", 0,
+		"delete the kept VMs older than this, same as for \"prepare\" (0 means no limit)")
+
+	return command
+}
+
+func runGC(cmd *cobra.Command, _ []string) error {
+	opts := gc.Options{
+		MinAge:       minAge,
+		ReuseMaxJobs: reuseMaxJobs,
+		ReuseMaxAge:  reuseMaxAge,
+	}
+
+	if jobStatusURL != "" {
+		opts.JobStatus = gc.NewJobStatusFunc(jobStatusURL, jobStatusToken)
+	}
+
+	if err := revokeStaleLeases(cmd.Context()); err != nil {
+		return err
+	}
+
+	if err := deleteStaleKeptVMs(cmd.Context(), opts); err != nil {
+		return err
+	}
+
+	staleVMs, err := gc.StaleVMs(cmd.Context(), tart.DefaultBackend, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, staleVM := range staleVMs {
+		if dryRun {
+			log.Printf("Would delete VM %s (%s)\n", staleVM.Name, staleVM.Reason)
+
+			continue
+		}
+
+		// Make sure that nobody claims the warm pool VM that is being deleted
+		if staleVM.PoolEntry != nil {
+			taken, err := pool.Take(*staleVM.PoolEntry)
+			if err != nil {
+				return err
+			}
+			if !taken {
+				continue
+			}
+		}
+
+		log.Printf("Deleting VM %s (%s)...\n", staleVM.Name, staleVM.Reason)
+
+		if staleVM.Running {
+			if err := tart.DefaultBackend.Stop(context.Background(), staleVM.Name); err != nil {
+				log.Printf("Failed to stop VM %s: %v\n", staleVM.Name, err)
+			}
+		}
+
+		if err := tart.DefaultBackend.Delete(context.Background(), staleVM.Name); err != nil {
+			log.Printf("Failed to delete VM %s: %v\n", staleVM.Name, err)
+		}
+	}
+
+	if err := deleteOrphanedPoolEntries(cmd.Context()); err != nil {
+		return err
+	}
+
+	// Host directories are only looked up after deleting the VMs,
+	// as they are considered stale when the job VM is gone
+	jobIDs, err := gc.JobIDs(cmd.Context(), tart.DefaultBackend)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		jobIDs = slices.DeleteFunc(jobIDs, func(jobID string) bool {
+			return slices.ContainsFunc(staleVMs, func(staleVM gc.StaleVM) bool {
+				return staleVM.JobID == jobID
+			})
+		})
+	}
+
+	// The jobs recorded by the "prepare" stage for the --job-status-url
+	staleJobs, err := gc.StaleJobs(jobIDs, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, staleJob := range staleJobs {
+		if dryRun {
+			log.Printf("Would forget job %s\n", staleJob)
+
+			continue
+		}
+
+		if err := gc.ForgetJob(staleJob); err != nil {
+			log.Printf("Failed to forget job %s: %v\n", staleJob, err)
+		}
+	}
+
+	staleHostDirs, err := gc.StaleHostDirs(tmpDirs, jobIDs, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, staleHostDir := range staleHostDirs {
+		if dryRun {
+			log.Printf("Would delete host directory %s\n", staleHostDir)
+
+			continue
+		}
+
+		log.Printf("Deleting host directory %s...\n", staleHostDir)
+
+		if err := os.RemoveAll(staleHostDir); err != nil {
+			log.Printf("Failed to delete host directory %s: %v\n", staleHostDir, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteOrphanedPoolEntries removes the warm pool entries
+// whose VMs were deleted behind the warm pool daemon's back.
+func deleteOrphanedPoolEntries(ctx context.Context) error {
+	orphanedPoolEntries, err := gc.OrphanedPoolEntries(ctx, tart.DefaultBackend)
+	if err != nil {
+		return err
+	}
+
+	for _, poolEntry := range orphanedPoolEntries {
+		if dryRun {
+			log.Printf("Would remove warm pool entry %s since its VM no longer exists\n", poolEntry.Name)
+
+			continue
+		}
+
+		log.Printf("Removing warm pool entry %s since its VM no longer exists...\n", poolEntry.Name)
+
+		if _, err := pool.Take(poolEntry); err != nil {
+			log.Printf("Failed to remove warm pool entry %s: %v\n", poolEntry.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// revokeStaleLeases makes the VMs kept between the jobs (see --reuse-project)
+// available again when the jobs that were using them are gone.
+func revokeStaleLeases(ctx context.Context) error {
+	leases, err := reuse.List()
+	if err != nil {
+		return err
+	}
+
+	for _, lease := range leases {
+		stale, err := lease.Stale(ctx, tart.DefaultBackend, max(minAge, reuse.StaleLeaseGracePeriod))
+		if err != nil {
+			return err
+		}
+
+		if !stale {
+			continue
+		}
+
+		if dryRun {
+			log.Printf("Would revoke the lease on VM %s held by job %s\n", lease.VMName, lease.JobID)
+
+			continue
+		}
+
+		log.Printf("Revoking the lease on VM %s held by job %s...\n", lease.VMName, lease.JobID)
+
+		if err := lease.Revoke(ctx, tart.DefaultBackend); err != nil {
+			log.Printf("Failed to revoke the lease on VM %s: %v\n", lease.VMName, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteStaleKeptVMs deletes the VMs kept between the jobs (see --reuse-project)
+// that are no longer used, along with their leases.
+func deleteStaleKeptVMs(ctx context.Context, opts gc.Options) error {
+	staleKeptVMs, err := gc.StaleKeptVMs(ctx, tart.DefaultBackend, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, staleKeptVM := range staleKeptVMs {
+		if dryRun {
+			log.Printf("Would delete VM %s (%s)\n", staleKeptVM.Name, staleKeptVM.Reason)
+
+			continue
+		}
+
+		log.Printf("Deleting VM %s (%s)...\n", staleKeptVM.Name, staleKeptVM.Reason)
+
+		if staleKeptVM.Lease == nil {
+			if staleKeptVM.Running {
+				_ = tart.DefaultBackend.Stop(ctx, staleKeptVM.Name)
+			}
+
+			if err := tart.DefaultBackend.Delete(ctx, staleKeptVM.Name); err != nil {
+				log.Printf("Failed to delete VM %s: %v\n", staleKeptVM.Name, err)
+			}
+
+			continue
+		}
+
+		deleted, err := staleKeptVM.Lease.Delete(ctx, tart.DefaultBackend)
+		if err != nil {
+			log.Printf("Failed to delete VM %s: %v\n", staleKeptVM.Name, err)
+		} else if !deleted {
+			log.Printf("Not deleting VM %s since it was leased by a job in the meantime\n", staleKeptVM.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,373 @@
+package pool
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/admission"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/dialer"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/eventlog"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/gitlab"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/localnetworkhelper"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/metrics"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/pool"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/resources"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"github.com/spf13/cobra"
+)
+
+var ErrFailed = errors.New("\"pool\" command failed")
+
+var images []string
+var size uint
+var interval time.Duration
+var bootTimeout time.Duration
+var concurrency uint64
+var cpuOverrideRaw string
+var memoryOverrideRaw string
+var customDirectoryMounts []string
+var customDiskMounts []string
+var nested bool
+var tartRunEnv []string
+var maxHostCPU uint64
+var maxHostMemory uint64
+
+func NewCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "pool",
+		Short: "Keep a warm pool of booted Tart VMs to be claimed by \"prepare --from-pool\"",
+		RunE:  runPool,
+	}
+
+	command.PersistentFlags().StringArrayVar(&images, "image", []string{},
+		"Tart image to keep the booted VMs for, can be specified multiple times")
+	command.PersistentFlags().UintVar(&size, "size", 1,
+		"number of booted VMs to keep for each image")
+	command.PersistentFlags().DurationVar(&interval, "interval", time.Minute,
+		"how often to replenish the pool, in addition to replenishing it after each \"cleanup\"")
+	command.PersistentFlags().DurationVar(&bootTimeout, "boot-timeout", 5*time.Minute,
+		"how long to wait for a VM to become reachable over SSH before discarding it")
+
+	// These need to match the "prepare" command-line arguments,
+	// otherwise the pool VMs won't be claimed
+	command.PersistentFlags().Uint64Var(&concurrency, "concurrency", 1,
+		"Maximum number of concurrently running Tart VMs to calculate the \"auto\" resources")
+	command.PersistentFlags().StringVar(&cpuOverrideRaw, "cpu", "",
+		"Override default image CPU configuration (number of CPUs or \"auto[-RESERVE][:PERCENT%][,min=MIN]\")")
+	command.PersistentFlags().StringVar(&memoryOverrideRaw, "memory", "",
+		"Override default image memory configuration (size in megabytes or \"auto[-RESERVE][:PERCENT%][,min=MIN]\")")
+	command.PersistentFlags().StringArrayVar(&customDirectoryMounts, "dir", []string{},
+		"\"--dir\" arguments to pass to \"tart run\", can be specified multiple times")
+	command.PersistentFlags().StringArrayVar(&customDiskMounts, "disk", []string{},
+		"\"--disk\" arguments to pass to \"tart run\", can be specified multiple times")
+	command.PersistentFlags().BoolVar(&nested, "nested", false,
+		"Run the VM with nested virtualization enabled")
+	command.PersistentFlags().StringArrayVar(&tartRunEnv, "tart-run-env", []string{},
+		"environment variable overrides for \"tart run\"")
+	command.PersistentFlags().Uint64Var(&maxHostCPU, "max-host-cpu", 0,
+		"Maximum total number of CPUs of the VMs running on the host, the pool VMs that don't fit "+
+			"are not booted (0 means no limit)")
+	command.PersistentFlags().Uint64Var(&maxHostMemory, "max-host-memory", 0,
+		"Maximum total memory (in megabytes) of the VMs running on the host, the pool VMs that don't fit "+
+			"are not booted (0 means no limit)")
+
+	localnetworkhelper.IntroduceFlag(command)
+
+	return command
+}
+
+func runPool(cmd *cobra.Command, _ []string) error {
+	if len(images) == 0 {
+		return fmt.Errorf("%w: at least one --image needs to be specified", ErrFailed)
+	}
+
+	// Unlike the GitLab Runner stages, the pool is
+	// a long-running process, so handle SIGTERM too
+	ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGTERM)
+	defer stop()
+
+	dialer, err := localnetworkhelper.ConnectAndDropPrivileges(ctx)
+	if err != nil {
+		return err
+	}
+
+	cpuOverride, err := resources.ParseCPUOverride(ctx, cpuOverrideRaw, concurrency)
+	if err != nil {
+		return err
+	}
+
+	memoryOverride, err := resources.ParseMemoryOverride(ctx, memoryOverrideRaw, concurrency)
+	if err != nil {
+		return err
+	}
+
+	config, err := tart.NewConfigFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	var specs []pool.Spec
+
+	for _, image := range images {
+		specs = append(specs, pool.Spec{
+			Image:      image,
+			CPU:        cpuOverride,
+			Memory:     memoryOverride,
+			Settings:   config.RunSettings(),
+			Nested:     nested,
+			Dirs:       customDirectoryMounts,
+			Disks:      customDiskMounts,
+			TartRunEnv: tartRunEnv,
+		})
+	}
+
+	replenishCh := make(chan os.Signal, 1)
+	signal.Notify(replenishCh, syscall.SIGUSR1)
+	defer signal.Stop(replenishCh)
+
+	// The PID file is not removed on exit, since it's
+	// the lock that tells whether the daemon is running
+	pidLock, err := pool.LockPIDFile()
+	if err != nil {
+		return err
+	}
+	defer pidLock.Unlock()
+
+	for {
+		if err := replenish(ctx, config, dialer, specs); err != nil {
+			log.Printf("Failed to replenish the warm pool: %v\n", err)
+		}
+
+		metrics.Flush()
+
+		select {
+		case <-ctx.Done():
+			return drain()
+		case <-replenishCh:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func replenish(ctx context.Context, config tart.Config, dialer dialer.Dialer, specs []pool.Spec) error {
+	entries, err := pool.Entries()
+	if err != nil {
+		return err
+	}
+
+	listEntries, err := tart.DefaultBackend.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	running := map[string]bool{}
+
+	for _, listEntry := range listEntries {
+		if listEntry.Source == "local" && listEntry.Running {
+			running[listEntry.Name] = true
+		}
+	}
+
+	var alive []pool.Entry
+
+	for _, entry := range entries {
+		if running[entry.Name] {
+			alive = append(alive, entry)
+
+			continue
+		}
+
+		// Make sure that nobody claims a VM that is no longer running
+		taken, err := pool.Take(entry)
+		if err != nil {
+			return err
+		}
+		if taken {
+			log.Printf("Discarding warm pool VM %s since it's no longer running\n", entry.Name)
+
+			_ = tart.DefaultBackend.Delete(ctx, entry.Name)
+		}
+	}
+
+	for _, spec := range specs {
+		var count uint
+
+		for _, entry := range alive {
+			if entry.Spec.Equal(spec) {
+				count++
+			}
+		}
+
+		for ; count < size; count++ {
+			if err := boot(ctx, config, dialer, spec); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func boot(ctx context.Context, config tart.Config, dialer dialer.Dialer, spec pool.Spec) error {
+	name, err := vmName()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Booting warm pool VM %s from %s...\n", name, spec.Image)
+
+	eventlog.SetJob("", spec.Image)
+
+	pullPolicy, err := config.PullPolicy()
+	if err != nil {
+		return err
+	}
+
+	imageLock, err := tart.UseImage(spec.Image)
+	if err != nil {
+		return err
+	}
+	defer imageLock.Unlock()
+
+	if err := tart.PullIfNeeded(ctx, tart.DefaultBackend, nil, spec.Image, pullPolicy,
+		config.PullOptions()); err != nil {
+		return err
+	}
+
+	// Clone from the digest-pinned image, so that the VM can be claimed by the jobs
+	// whose image was resolved to the same digest (e.g. with --allow-digest)
+	pinnedImage, err := tart.DefaultBackend.FQN(ctx, spec.Image)
+	if err != nil {
+		log.Printf("Failed to resolve %s to a digest, the VM will only be claimed by the jobs "+
+			"that use the image as is: %v\n", spec.Image, err)
+
+		pinnedImage = ""
+	}
+
+	vm, err := tart.CreateNewVM(ctx, tart.DefaultBackend, name, cmp.Or(pinnedImage, spec.Image), config,
+		spec.CPU, spec.Memory, nil)
+	if err != nil {
+		return err
+	}
+
+	// The reservation is handed over to the job when the VM is claimed
+	if err := admission.Admit(ctx, tart.DefaultBackend, name, admission.Options{
+		MaxCPU:    maxHostCPU,
+		MaxMemory: maxHostMemory,
+	}); err != nil {
+		discard(vm)
+
+		return err
+	}
+
+	if err := vm.Start(ctx, config, &gitlab.Env{}, spec.Dirs, spec.Disks, spec.Nested,
+		spec.TartRunEnv); err != nil {
+		discard(vm)
+
+		return err
+	}
+
+	if err := waitForSSH(ctx, config, dialer, vm); err != nil {
+		discard(vm)
+
+		return err
+	}
+
+	if err := pool.Add(pool.Entry{
+		Name:        name,
+		Spec:        spec,
+		PinnedImage: pinnedImage,
+		OutputPath:  vm.TartRunOutputPath(),
+		PIDPath:     vm.TartRunPIDPath(),
+		CreatedAt:   time.Now(),
+	}); err != nil {
+		discard(vm)
+
+		return err
+	}
+
+	log.Printf("Warm pool VM %s is ready\n", name)
+
+	return nil
+}
+
+// waitForSSH only waits for the SSH port to become reachable
+// because the credentials might differ from job to job.
+func waitForSSH(ctx context.Context, config tart.Config, dialer dialer.Dialer, vm *tart.VM) error {
+	ctx, cancel := context.WithTimeout(ctx, bootTimeout)
+	defer cancel()
+
+	return retry.Do(func() error {
+		ip, err := vm.IP(ctx, config)
+		if err != nil {
+			return err
+		}
+
+		addr := net.JoinHostPort(ip, strconv.FormatUint(uint64(config.SSHPort), 10))
+
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}, retry.Context(ctx), retry.Attempts(0), retry.Delay(time.Second),
+		retry.DelayType(retry.FixedDelay))
+}
+
+func drain() error {
+	entries, err := pool.Entries()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		taken, err := pool.Take(entry)
+		if err != nil {
+			return err
+		}
+		if !taken {
+			continue
+		}
+
+		log.Printf("Deleting warm pool VM %s...\n", entry.Name)
+
+		_ = tart.DefaultBackend.Stop(context.Background(), entry.Name)
+
+		if err := tart.DefaultBackend.Delete(context.Background(), entry.Name); err != nil {
+			log.Printf("Failed to delete warm pool VM %s: %v\n", entry.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func discard(vm *tart.VM) {
+	_ = vm.Stop()
+
+	if err := vm.Delete(); err != nil {
+		log.Printf("Failed to delete warm pool VM %s: %v\n", vm.Name(), err)
+	}
+}
+
+func vmName() (string, error) {
+	suffix := make([]byte, 4)
+
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+
+	return pool.VMNamePrefix + hex.EncodeToString(suffix), nil
+}
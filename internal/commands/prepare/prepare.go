@@ -1,39 +1,37 @@
 package prepare
 
 import (
-	"bytes"
 	"context"
-	_ "embed"
 	"errors"
 	"fmt"
 	"log"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 
-	"github.com/Masterminds/semver/v3"
-	"github.com/alecthomas/units"
 	"github.com/bmatcuk/doublestar/v4"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/admission"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/diskspace"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/eventlog"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/gc"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/gitlab"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/guest"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/imagealias"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/imagepolicy"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/imageverify"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/localnetworkhelper"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/metrics"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/pool"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/resources"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/shell"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/timezone"
-	"github.com/shirou/gopsutil/v3/cpu"
-	"github.com/shirou/gopsutil/v3/mem"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
 )
 
 var ErrFailed = errors.New("\"prepare\" stage failed")
 
-//go:embed install-gitlab-runner-auto.sh
-var installGitlabRunnerScriptAuto string
-
-//go:embed install-gitlab-runner-brew.sh
-var installGitlabRunnerBrewScript string
-
-//go:embed install-gitlab-runner-curl.sh
-var installGitlabRunnerCurlScript string
-
 var concurrency uint64
 var cpuOverrideRaw string
 var memoryOverrideRaw string
@@ -41,16 +39,50 @@ var customDirectoryMounts []string
 var customDiskMounts []string
 var autoPrune bool
 var allowedImagePatterns []string
+var deniedImagePatterns []string
+var restrictedImageRules []string
+var gitLabURL string
+var requireDigest bool
+var allowedDigests []string
+var imagePublicKeyPath string
 var defaultImage string
 var nested bool
 var tartRunEnv []string
+var sshKnownHosts []string
+var fromPool bool
+var reuseProjectPatterns []string
+var reuseMaxJobs uint
+var reuseMaxAge time.Duration
+var reuseResetScriptPath string
+var ipTimeout time.Duration
+var bootTimeout time.Duration
+var sshRetryDelay time.Duration
+var minFreeDisk uint64
+var imageCacheBudget uint64
+var maxHostCPU uint64
+var maxHostMemory uint64
+var admissionWait time.Duration
+var minCPU uint64
+var maxCPU uint64
+var minMemory uint64
+var maxMemory uint64
+var diskSize uint64
+var maxDiskSize uint64
+var growPartition bool
+var prepareScriptPaths []string
+var prepareScriptTimeout time.Duration
 
 func NewCommand() *cobra.Command {
 	command := &cobra.Command{
 		Use:   "prepare",
 		Short: "Prepare a Tart VM for execution",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if err := runPrepareVM(cmd, args); err != nil {
+			err := runPrepareVM(cmd, args)
+
+			eventlog.Finish(err)
+			metrics.Flush()
+
+			if err != nil {
 				return gitlab.NewSystemFailureError(err)
 			}
 
@@ -61,9 +93,28 @@ func NewCommand() *cobra.Command {
 	command.PersistentFlags().Uint64Var(&concurrency, "concurrency", 1,
 		"Maximum number of concurrently running Tart VMs to calculate the \"auto\" resources")
 	command.PersistentFlags().StringVar(&cpuOverrideRaw, "cpu", "",
-		"Override default image CPU configuration (number of CPUs or \"auto\")")
+		"Override default image CPU configuration (number of CPUs or \"auto[-RESERVE][:PERCENT%][,min=MIN]\")")
 	command.PersistentFlags().StringVar(&memoryOverrideRaw, "memory", "",
-		"Override default image memory configuration (size in megabytes or \"auto\")")
+		"Override default image memory configuration (size in megabytes or \"auto[-RESERVE][:PERCENT%][,min=MIN]\")")
+	command.PersistentFlags().Uint64Var(&minCPU, "min-cpu", 0,
+		"minimum number of CPUs that the job can request using the TART_EXECUTOR_CPU variable (0 means no limit)")
+	command.PersistentFlags().Uint64Var(&maxCPU, "max-cpu", 0,
+		"maximum number of CPUs that the job can request using the TART_EXECUTOR_CPU variable "+
+			"(0 means that the job's request is ignored)")
+	command.PersistentFlags().Uint64Var(&minMemory, "min-memory", 0,
+		"minimum memory in megabytes that the job can request using the TART_EXECUTOR_MEMORY variable "+
+			"(0 means no limit)")
+	command.PersistentFlags().Uint64Var(&maxMemory, "max-memory", 0,
+		"maximum memory in megabytes that the job can request using the TART_EXECUTOR_MEMORY variable "+
+			"(0 means that the job's request is ignored)")
+	command.PersistentFlags().Uint64Var(&diskSize, "disk-size", 0,
+		"grow the VM's disk to the given size in gigabytes after cloning (0 means the image's disk size)")
+	command.PersistentFlags().Uint64Var(&maxDiskSize, "max-disk-size", 0,
+		"maximum disk size in gigabytes that the job can request using the TART_EXECUTOR_DISK_SIZE variable "+
+			"(0 means that the job's request is ignored)")
+	command.PersistentFlags().BoolVar(&growPartition, "grow-partition", false,
+		"grow the guest's root partition to fill the disk when its size is overridden "+
+			"(macOS APFS container, Linux ext4 or XFS root partition)")
 	command.PersistentFlags().StringArrayVar(&customDirectoryMounts, "dir", []string{},
 		"\"--dir\" arguments to pass to \"tart run\", can be specified multiple times")
 	command.PersistentFlags().StringArrayVar(&customDiskMounts, "disk", []string{},
@@ -74,13 +125,83 @@ func NewCommand() *cobra.Command {
 	command.PersistentFlags().StringArrayVar(&allowedImagePatterns, "allow-image", []string{},
 		"only allow running images that match the given doublestar-compatible pattern, "+
 			"can be specified multiple times (e.g. --allow-image \"ghcr.io/cirruslabs/macos-sonoma-*\")")
+	command.PersistentFlags().StringArrayVar(&deniedImagePatterns, "deny-image", []string{},
+		"deny running images that match the given doublestar-compatible pattern, even if they are "+
+			"allowed by --allow-image, can be specified multiple times")
+	command.PersistentFlags().StringArrayVar(&restrictedImageRules, "restrict-image", []string{},
+		"only allow running images that match the given doublestar-compatible pattern in projects "+
+			"whose path (e.g. \"group/subgroup/project\") matches the given doublestar-compatible pattern, "+
+			"can be specified multiple times (e.g. --restrict-image \"**/*-xcode-beta*=infra/**\")")
+	command.PersistentFlags().StringVar(&gitLabURL, "gitlab-url", "",
+		"URL of the GitLab instance (e.g. \"https://gitlab.com\") to verify the job's project "+
+			"against using its CI_JOB_TOKEN, since the job can override CI_PROJECT_PATH "+
+			"(used by --restrict-image and --reuse-project)")
+	command.PersistentFlags().BoolVar(&requireDigest, "require-digest", false,
+		"only allow running images pinned to a digest (e.g. \"ghcr.io/cirruslabs/macos-sonoma-base@sha256:...\")")
+	command.PersistentFlags().StringArrayVar(&allowedDigests, "allow-digest", []string{},
+		"only allow running images whose digest (e.g. \"sha256:...\") is in the given list, "+
+			"can be specified multiple times")
+	command.PersistentFlags().StringVar(&imagePublicKeyPath, "image-public-key", "",
+		"path to a public key to verify the image's signature against using \"cosign verify\"")
+	command.PersistentFlags().StringArrayVar(&prepareScriptPaths, "prepare-script", []string{},
+		"path to a script on the host to run in the VM after it boots, before the job's "+
+			"TART_EXECUTOR_PREPARE_SCRIPT, can be specified multiple times")
+	command.PersistentFlags().DurationVar(&prepareScriptTimeout, "prepare-script-timeout", 10*time.Minute,
+		"how long each of the --prepare-script scripts and the TART_EXECUTOR_PREPARE_SCRIPT "+
+			"may run before failing the job (0 means no timeout)")
 	command.PersistentFlags().StringVar(&defaultImage, "default-image", "",
 		"A fallback Tart image to use, in case the job does not specify one")
 	command.PersistentFlags().BoolVar(&nested, "nested", false,
 		"Run the VM with nested virtualization enabled")
 	command.PersistentFlags().StringArrayVar(&tartRunEnv, "tart-run-env", []string{},
 		"environment variable overrides for \"tart run\"")
-
+	command.PersistentFlags().StringArrayVar(&sshKnownHosts, "ssh-known-hosts", []string{},
+		"path to a known_hosts file to verify the VM's SSH host key against instead of pinning "+
+			"the host key presented on first connection, can be specified multiple times")
+
+	command.PersistentFlags().DurationVar(&ipTimeout, "ip-timeout", tart.DefaultIPTimeout,
+		"how long to wait for the VM to obtain an IP address in a single \"tart ip\" invocation "+
+			"(can be overridden by the job using the TART_EXECUTOR_IP_TIMEOUT variable)")
+	command.PersistentFlags().DurationVar(&bootTimeout, "boot-timeout", tart.DefaultBootTimeout,
+		"how long to wait for the VM to become SSH-able before failing the job "+
+			"(can be overridden by the job using the TART_EXECUTOR_BOOT_TIMEOUT variable)")
+	command.PersistentFlags().DurationVar(&sshRetryDelay, "ssh-retry-delay", tart.DefaultSSHRetryDelay,
+		"delay between the attempts to obtain the VM's IP address and to connect to it via SSH "+
+			"(can be overridden by the job using the TART_EXECUTOR_SSH_RETRY_DELAY variable)")
+
+	command.PersistentFlags().Uint64Var(&minFreeDisk, "min-free-disk", 0,
+		"amount of free space in gigabytes to keep on the Tart home volume in addition to the image size, "+
+			"least recently used cached images are evicted to make room, and the job fails early when "+
+			"that's not enough (0 means no check)")
+	command.PersistentFlags().Uint64Var(&imageCacheBudget, "image-cache-budget", 0,
+		"maximum total size in gigabytes of the images cached by Tart, least recently used cached images "+
+			"are evicted to stay within the budget (0 means no limit)")
+
+	command.PersistentFlags().Uint64Var(&maxHostCPU, "max-host-cpu", 0,
+		"maximum total number of CPUs of the VMs running on the host, jobs whose VM doesn't fit "+
+			"wait for the other jobs to finish (see --admission-wait) or fail (0 means no limit)")
+	command.PersistentFlags().Uint64Var(&maxHostMemory, "max-host-memory", 0,
+		"maximum total memory in megabytes of the VMs running on the host, jobs whose VM doesn't fit "+
+			"wait for the other jobs to finish (see --admission-wait) or fail (0 means no limit)")
+	command.PersistentFlags().DurationVar(&admissionWait, "admission-wait", 0,
+		"how long to wait for the other jobs to release the CPUs and memory when the VM doesn't fit "+
+			"into the --max-host-cpu and --max-host-memory limits before failing the job")
+
+	command.PersistentFlags().BoolVar(&fromPool, "from-pool", false,
+		"claim an already booted VM from the warm pool maintained by the \"pool\" command, "+
+			"falling back to cloning a new VM when no matching VMs are available")
+
+	command.PersistentFlags().StringArrayVar(&reuseProjectPatterns, "reuse-project", []string{},
+		"keep the VM between the jobs of projects whose path matches the given doublestar-compatible "+
+			"pattern (one VM per project and image), can be specified multiple times")
+	command.PersistentFlags().UintVar(&reuseMaxJobs, "reuse-max-jobs", 0,
+		"maximum number of jobs to run in a kept VM before re-creating it (0 means no limit)")
+	command.PersistentFlags().DurationVar(&reuseMaxAge, "reuse-max-age", 0,
+		"maximum age of a kept VM before re-creating it (0 means no limit)")
+	command.PersistentFlags().StringVar(&reuseResetScriptPath, "reuse-reset-script", "",
+		"path to a script on the host to run in a kept VM before each subsequent job")
+
+	imagealias.IntroduceFlag(command)
 	localnetworkhelper.IntroduceFlag(command)
 
 	return command
@@ -93,12 +214,12 @@ func runPrepareVM(cmd *cobra.Command, _ []string) error {
 		return err
 	}
 
-	cpuOverride, err := parseCPUOverride(cmd.Context(), cpuOverrideRaw)
+	cpuOverride, err := resources.ParseCPUOverride(cmd.Context(), cpuOverrideRaw, concurrency)
 	if err != nil {
 		return err
 	}
 
-	memoryOverride, err := parseMemoryOverride(cmd.Context(), memoryOverrideRaw)
+	memoryOverride, err := resources.ParseMemoryOverride(cmd.Context(), memoryOverrideRaw, concurrency)
 	if err != nil {
 		return err
 	}
@@ -116,6 +237,15 @@ func runPrepareVM(cmd *cobra.Command, _ []string) error {
 		return err
 	}
 
+	if gitLabURL != "" {
+		if err := gitLabEnv.VerifyProject(cmd.Context(), gitLabURL); err != nil {
+			return err
+		}
+	} else if len(restrictedImageRules) != 0 {
+		log.Println("Warning: --restrict-image relies on the project path set by the job itself, " +
+			"pass --gitlab-url to verify it")
+	}
+
 	if gitLabEnv.JobImage == "" {
 		if defaultImage == "" {
 			return fmt.Errorf("%w: CUSTOM_ENV_CI_JOB_ID is missing and no --default-image was set", ErrFailed)
@@ -125,110 +255,201 @@ func runPrepareVM(cmd *cobra.Command, _ []string) error {
 		log.Printf("No image provided, falling back to default: %s\n", defaultImage)
 	}
 
-	if err := ensureImageIsAllowed(gitLabEnv.JobImage); err != nil {
+	if image, ok, err := imagealias.Resolve(gitLabEnv.JobImage); err != nil {
 		return err
+	} else if ok {
+		log.Printf("Resolved image alias %s to %s\n", gitLabEnv.JobImage, image)
+
+		gitLabEnv.JobImage = image
 	}
 
-	config, err := tart.NewConfigFromEnvironment()
-	if err != nil {
+	eventlog.SetJob(gitLabEnv.JobID, gitLabEnv.JobImage)
+
+	// Let the "gc" command query the status of the job in the right project
+	if err := gc.RecordJob(gitLabEnv.JobID, gitLabEnv.ProjectID); err != nil {
 		return err
 	}
 
-	additionalCloneAndPullEnv := additionalPullEnv(gitLabEnv.Registry)
+	imageRules := imagepolicy.Rules{
+		Allow:    allowedImagePatterns,
+		Deny:     deniedImagePatterns,
+		Restrict: restrictedImageRules,
+	}
 
-	if config.AlwaysPull {
-		log.Printf("Pulling the latest version of %s...\n", gitLabEnv.JobImage)
+	if err := imageRules.Check(gitLabEnv.JobImage, gitLabEnv.ProjectPath); err != nil {
+		return err
+	}
 
-		pullArgs := []string{"pull", gitLabEnv.JobImage}
+	config, err := tart.NewConfigFromEnvironment()
+	if err != nil {
+		return err
+	}
 
-		if config.InsecurePull {
-			pullArgs = append(pullArgs, "--insecure")
-		}
+	config.SetDefaultTimeouts(ipTimeout, bootTimeout, sshRetryDelay)
 
-		if config.PullConcurrency != 0 {
-			pullArgs = append(pullArgs, "--concurrency",
-				strconv.FormatUint(uint64(config.PullConcurrency), 10))
+	// Job's requests take precedence over the command-line arguments
+	if config.CPU != "" {
+		requestedCPU, err := resources.ParseCPUOverride(cmd.Context(), config.CPU, concurrency)
+		if err != nil {
+			return fmt.Errorf("%w: invalid TART_EXECUTOR_CPU: %v", ErrFailed, err)
 		}
 
-		_, _, err := tart.TartExecWithEnv(cmd.Context(), additionalCloneAndPullEnv, pullArgs...)
+		cpuOverride = clampJobRequest("CPUs", "--max-cpu", requestedCPU, cpuOverride, minCPU, maxCPU)
+	}
+
+	if config.Memory != "" {
+		requestedMemory, err := resources.ParseMemoryOverride(cmd.Context(), config.Memory, concurrency)
 		if err != nil {
-			return err
+			return fmt.Errorf("%w: invalid TART_EXECUTOR_MEMORY: %v", ErrFailed, err)
 		}
+
+		memoryOverride = clampJobRequest("MB of memory", "--max-memory", requestedMemory, memoryOverride,
+			minMemory, maxMemory)
 	}
 
-	vm, err := tart.CreateNewVM(cmd.Context(), gitLabEnv.VirtualMachineID(), gitLabEnv.JobImage,
-		config, cpuOverride, memoryOverride, additionalCloneAndPullEnv)
+	if config.DiskSize != 0 {
+		config.DiskSize = clampJobRequest("GB of disk", "--max-disk-size", config.DiskSize, diskSize, 0, maxDiskSize)
+	} else {
+		config.DiskSize = diskSize
+	}
+
+	pullPolicy, err := config.PullPolicy()
 	if err != nil {
 		return err
 	}
-	err = vm.Start(config, gitLabEnv, customDirectoryMounts, customDiskMounts, nested, tartRunEnv)
+
+	// Prevent the other jobs on this host from evicting
+	// the image until the VM is cloned from it
+	imageLock, err := tart.UseImage(gitLabEnv.JobImage)
 	if err != nil {
 		return err
 	}
+	defer imageLock.Unlock()
 
-	// Monitor "tart run" command's output so it's not silenced
-	go vm.MonitorTartRunOutput()
+	if err := diskspace.Preflight(cmd.Context(), tart.DefaultBackend, gitLabEnv.JobImage, diskspace.Options{
+		MinFree:    minFreeDisk,
+		Budget:     imageCacheBudget,
+		PullPolicy: pullPolicy,
+	}); err != nil {
+		return err
+	}
 
-	log.Println("Waiting for the VM to boot and be SSH-able...")
-	ssh, err := vm.OpenSSH(cmd.Context(), config, dialer)
+	// Use the verified digest-pinned image from now on, so
+	// that it's not affected by the tag being re-pointed
+	gitLabEnv.JobImage, err = imageverify.Verify(cmd.Context(), tart.DefaultBackend, gitLabEnv.JobImage,
+		additionalPullEnv(gitLabEnv.Registry), pullPolicy, config.PullOptions(), imageverify.Options{
+			RequireDigest:  requireDigest,
+			AllowedDigests: allowedDigests,
+			PublicKeyPath:  imagePublicKeyPath,
+		})
 	if err != nil {
 		return err
 	}
-	defer ssh.Close()
 
-	log.Println("Was able to SSH!")
+	pinnedImageLock, err := tart.UseImage(gitLabEnv.JobImage)
+	if err != nil {
+		return err
+	}
+	defer pinnedImageLock.Unlock()
+
+	var vm *tart.VM
 
-	installGitlabRunnerScript, err := installGitlabRunnerScript(config.InstallGitlabRunner)
+	reuseLease, err := acquireReuseLease(cmd.Context(), gitLabEnv)
 	if err != nil {
 		return err
 	}
 
-	if installGitlabRunnerScript != "" {
-		log.Println("Installing GitLab Runner...")
+	if reuseLease != nil {
+		vm, err = startReusedVM(cmd.Context(), reuseLease, gitLabEnv, config, cpuOverride, memoryOverride)
+		if err != nil {
+			return err
+		}
+	}
+
+	reused := vm != nil
 
-		session, err := ssh.NewSession()
+	if vm == nil && fromPool {
+		vm, err = claimFromPool(cmd.Context(), gitLabEnv, config, cpuOverride, memoryOverride)
 		if err != nil {
 			return err
 		}
-		defer session.Close()
+	}
 
-		stdinBuf, err := session.StdinPipe()
+	if vm == nil {
+		vm, err = cloneAndStartVM(cmd.Context(), gitLabEnv, config, cpuOverride, memoryOverride)
 		if err != nil {
 			return err
 		}
+	}
 
-		session.Stdout = os.Stdout
-		session.Stderr = os.Stderr
+	if reuseLease != nil {
+		if reuseLease.Jobs == 0 {
+			reuseLease.Reset()
+		}
 
-		if err := session.Shell(); err != nil {
+		reuseLease.Jobs++
+
+		if err := reuseLease.Save(); err != nil {
 			return err
 		}
+	}
 
-		// Expose GitLab job environment variables to GitLab Runner installation script
-		for _, keyAndValue := range os.Environ() {
-			keyAndValue, found := strings.CutPrefix(keyAndValue, "CUSTOM_ENV_")
-			if !found {
-				// Doesn't look like a GitLab job environment variable
-				continue
-			}
+	// Monitor "tart run" command's output so it's not silenced
+	go vm.MonitorTartRunOutput()
 
-			key, value, _ := strings.Cut(keyAndValue, "=")
+	hostKeyCallback, err := vm.HostKeyCallback(sshKnownHosts, true)
+	if err != nil {
+		return err
+	}
 
-			if _, err := fmt.Fprintf(stdinBuf, "export %s=%s\n", key, quote(value)); err != nil {
-				return err
-			}
-		}
+	log.Println("Waiting for the VM to boot and be SSH-able...")
+	sshClient, err := vm.OpenSSH(cmd.Context(), config, dialer, hostKeyCallback)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
 
-		// Perform GitLab Runner installation
-		if _, err := stdinBuf.Write([]byte(installGitlabRunnerScript)); err != nil {
+	log.Println("Was able to SSH!")
+
+	if reused {
+		if err := resetReusedVM(cmd.Context(), sshClient); err != nil {
 			return err
 		}
+	}
 
-		if err := stdinBuf.Close(); err != nil {
+	vmInfo, err := vm.Info(cmd.Context())
+	if err != nil {
+		return err
+	}
+
+	guestDriver, err := guest.NewDriver(vmInfo.OS)
+	if err != nil {
+		return err
+	}
+
+	if growPartition && config.DiskSize != 0 {
+		log.Println("Growing the guest's partition...")
+
+		step := eventlog.Begin("grow_partition", vm.Name())
+		err := runScriptInGuest(cmd.Context(), sshClient, guestDriver.GrowPartitionScript())
+		step.End(err)
+		if err != nil {
 			return err
 		}
+	}
 
-		if err := session.Wait(); err != nil {
+	installGitlabRunnerScript, err := guestDriver.InstallGitlabRunnerScript(config.InstallGitlabRunner)
+	if err != nil {
+		return err
+	}
+
+	if installGitlabRunnerScript != "" {
+		log.Println("Installing GitLab Runner...")
+
+		step := eventlog.Begin("install_runner", vm.Name())
+		err := runScriptInGuest(cmd.Context(), sshClient, installGitlabRunnerScript)
+		step.End(err)
+		if err != nil {
 			return err
 		}
 	}
@@ -241,13 +462,13 @@ func runPrepareVM(cmd *cobra.Command, _ []string) error {
 			return err
 		}
 
-		session, err := ssh.NewSession()
+		session, err := sshClient.NewSession()
 		if err != nil {
 			return err
 		}
 		defer session.Close()
 
-		if err := session.Run(fmt.Sprintf("sudo systemsetup settimezone %s", tz)); err != nil {
+		if err := session.Run(guestDriver.SetTimezoneCommand(tz)); err != nil {
 			return err
 		}
 
@@ -259,11 +480,6 @@ func runPrepareVM(cmd *cobra.Command, _ []string) error {
 		Path string
 	}
 
-	vmInfo, err := vm.Info(cmd.Context())
-	if err != nil {
-		return err
-	}
-
 	var mountPoints []MountPoint
 
 	if _, ok := os.LookupEnv(tart.EnvTartExecutorInternalBuildsDirOnHost); ok {
@@ -282,58 +498,236 @@ func runPrepareVM(cmd *cobra.Command, _ []string) error {
 	for _, mountPoint := range mountPoints {
 		log.Printf("Mounting %s on %s...\n", mountPoint.Name, mountPoint.Path)
 
-		session, err := ssh.NewSession()
+		session, err := sshClient.NewSession()
 		if err != nil {
 			return err
 		}
 		defer session.Close()
 
-		var command string
-
-		if vmInfo.OS == "darwin" {
-			command = "mount_virtiofs"
-		} else {
-			command = "sudo mount -t virtiofs"
-		}
-
-		mkdirScript := fmt.Sprintf("mkdir -p %s", mountPoint.Path)
-		mountScript := fmt.Sprintf("%s tart.virtiofs.%s.%s %s", command, mountPoint.Name,
-			gitLabEnv.JobID, mountPoint.Path)
-		session.Stdin = bytes.NewBufferString(strings.Join([]string{mkdirScript, mountScript, ""}, "\n"))
+		tag := fmt.Sprintf("tart.virtiofs.%s.%s", mountPoint.Name, gitLabEnv.JobID)
+		session.Stdin = strings.NewReader(guestDriver.MountScript(tag, mountPoint.Path))
 		session.Stdout = os.Stdout
 		session.Stderr = os.Stderr
 
+		step := eventlog.Begin("mount", vm.Name())
+
 		if err := session.Shell(); err != nil {
+			step.End(err)
+
 			return err
 		}
 
-		if err := session.Wait(); err != nil {
+		err = session.Wait()
+		step.End(err)
+		if err != nil {
 			return err
 		}
 	}
 
+	if err := runPrepareScripts(cmd.Context(), vm, sshClient, config.PrepareScript); err != nil {
+		return err
+	}
+
 	log.Println("VM is ready.")
 
 	return nil
 }
 
-func ensureImageIsAllowed(image string) error {
-	if len(allowedImagePatterns) == 0 {
-		return nil
+// runPrepareScripts runs the operator's scripts followed by the job's script, if any.
+func runPrepareScripts(ctx context.Context, vm *tart.VM, sshClient *ssh.Client, jobScript string) error {
+	type prepareScript struct {
+		Name   string
+		Script string
 	}
 
-	for _, allowedImagePattern := range allowedImagePatterns {
-		match, err := doublestar.Match(allowedImagePattern, image)
+	var prepareScripts []prepareScript
+
+	for _, prepareScriptPath := range prepareScriptPaths {
+		scriptBytes, err := os.ReadFile(prepareScriptPath)
 		if err != nil {
 			return err
 		}
 
+		prepareScripts = append(prepareScripts, prepareScript{
+			Name:   prepareScriptPath,
+			Script: string(scriptBytes),
+		})
+	}
+
+	if jobScript != "" {
+		prepareScripts = append(prepareScripts, prepareScript{
+			Name:   "TART_EXECUTOR_PREPARE_SCRIPT",
+			Script: jobScript,
+		})
+	}
+
+	for _, prepareScript := range prepareScripts {
+		log.Printf("Running %s...\n", prepareScript.Name)
+
+		step := eventlog.Begin("prepare_script", vm.Name())
+		err := runPrepareScript(ctx, sshClient, prepareScript.Script)
+		step.End(err)
+		if err != nil {
+			return fmt.Errorf("%w: %s failed: %v", ErrFailed, prepareScript.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func runPrepareScript(ctx context.Context, sshClient *ssh.Client, script string) error {
+	if prepareScriptTimeout != 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeoutCause(ctx, prepareScriptTimeout,
+			fmt.Errorf("timed out after %s", prepareScriptTimeout))
+		defer cancel()
+	}
+
+	// Make sure that the script ends with a newline,
+	// otherwise its last command won't be run
+	if !strings.HasSuffix(script, "\n") {
+		script += "\n"
+	}
+
+	return runScriptInGuest(ctx, sshClient, script)
+}
+
+func cloneAndStartVM(
+	ctx context.Context,
+	gitLabEnv *gitlab.Env,
+	config tart.Config,
+	cpuOverride uint64,
+	memoryOverride uint64,
+) (*tart.VM, error) {
+	additionalCloneAndPullEnv := additionalPullEnv(gitLabEnv.Registry)
+
+	pullPolicy, err := config.PullPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tart.PullIfNeeded(ctx, tart.DefaultBackend, additionalCloneAndPullEnv, gitLabEnv.JobImage,
+		pullPolicy, config.PullOptions()); err != nil {
+		return nil, err
+	}
+
+	vm, err := tart.CreateNewVM(ctx, tart.DefaultBackend, gitLabEnv.VirtualMachineID(),
+		gitLabEnv.JobImage, config, cpuOverride, memoryOverride, additionalCloneAndPullEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := admission.Admit(ctx, tart.DefaultBackend, vm.Name(), admissionOptions()); err != nil {
+		return nil, err
+	}
+
+	err = vm.Start(ctx, config, gitLabEnv, customDirectoryMounts, customDiskMounts, nested, tartRunEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+//nolint:nilnil // having no matching VMs in the pool is not an error
+func claimFromPool(
+	ctx context.Context,
+	gitLabEnv *gitlab.Env,
+	config tart.Config,
+	cpuOverride uint64,
+	memoryOverride uint64,
+) (*tart.VM, error) {
+	// Warm pool VMs are booted before the job is known,
+	// so they can't have the job's directories mounted
+	_, buildsDirOnHost := os.LookupEnv(tart.EnvTartExecutorInternalBuildsDirOnHost)
+	_, cacheDirOnHost := os.LookupEnv(tart.EnvTartExecutorInternalCacheDirOnHost)
+	if buildsDirOnHost || cacheDirOnHost {
+		log.Println("Not using the warm pool since the job needs directories mounted from the host")
+
+		return nil, nil
+	}
+
+	vm, err := pool.Claim(ctx, tart.DefaultBackend, pool.Spec{
+		Image:      gitLabEnv.JobImage,
+		CPU:        cpuOverride,
+		Memory:     memoryOverride,
+		Settings:   config.RunSettings(),
+		Nested:     nested,
+		Dirs:       customDirectoryMounts,
+		Disks:      customDiskMounts,
+		TartRunEnv: tartRunEnv,
+	}, gitLabEnv.VirtualMachineID())
+	if err != nil {
+		return nil, err
+	}
+
+	if vm == nil {
+		log.Println("No matching VMs in the warm pool, cloning a new VM...")
+
+		return nil, nil
+	}
+
+	log.Println("Claimed a VM from the warm pool")
+
+	// Normally the warm pool daemon has already reserved the resources
+	// of the VM, but it might have been running with different limits
+	if err := admission.Admit(ctx, tart.DefaultBackend, vm.Name(), admissionOptions()); err != nil {
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+func matchAny(patterns []string, s string) (bool, error) {
+	for _, pattern := range patterns {
+		match, err := doublestar.Match(pattern, s)
+		if err != nil {
+			return false, err
+		}
+
 		if match {
-			return nil
+			return true, nil
 		}
 	}
 
-	return fmt.Errorf("image %q is disallowed by GitLab Runner configuration", image)
+	return false, nil
+}
+
+// clampJobRequest only honors the job's request when the operator has set the upper bound,
+// otherwise the job could request all the resources of the host (or more).
+func clampJobRequest(
+	what string,
+	upperBoundFlag string,
+	requested uint64,
+	fallback uint64,
+	lowerBound uint64,
+	upperBound uint64,
+) uint64 {
+	if upperBound == 0 {
+		log.Printf("Ignoring the job's request for %d %s since %s is not set\n", requested, what, upperBoundFlag)
+
+		return fallback
+	}
+
+	result := resources.Clamp(requested, lowerBound, upperBound)
+
+	if result != requested {
+		log.Printf("Job requested %d %s, using %d %s instead to stay within the allowed bounds\n",
+			requested, what, result, what)
+	} else {
+		log.Printf("Job requested %d %s\n", requested, what)
+	}
+
+	return result
+}
+
+func admissionOptions() admission.Options {
+	return admission.Options{
+		MaxCPU:    maxHostCPU,
+		MaxMemory: maxHostMemory,
+		Wait:      admissionWait,
+	}
 }
 
 func additionalPullEnv(registry *gitlab.Registry) map[string]string {
@@ -366,73 +760,64 @@ func additionalPullEnv(registry *gitlab.Registry) map[string]string {
 	return nil
 }
 
-func parseCPUOverride(ctx context.Context, override string) (uint64, error) {
-	// No override
-	if override == "" {
-		return 0, nil
+// runScriptInGuest runs the script in the guest's default shell
+// with the GitLab job environment variables exposed to it.
+func runScriptInGuest(ctx context.Context, sshClient *ssh.Client, script string) error {
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return err
 	}
+	defer session.Close()
 
-	// "Auto" override
-	if override == "auto" {
-		count, err := cpu.CountsWithContext(ctx, true)
-		if err != nil {
-			return 0, err
-		}
+	// Closing the session terminates the script
+	stop := context.AfterFunc(ctx, func() {
+		_ = session.Close()
+	})
+	defer stop()
 
-		//nolint:gosec // there's no overflow since cpu.CountsWithContext() returns positive values
-		return uint64(count) / concurrency, nil
+	stdinBuf, err := session.StdinPipe()
+	if err != nil {
+		return err
 	}
 
-	// Exact override
-	return strconv.ParseUint(override, 10, 64)
-}
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
 
-func parseMemoryOverride(ctx context.Context, override string) (uint64, error) {
-	// No override
-	if override == "" {
-		return 0, nil
+	if err := session.Shell(); err != nil {
+		return err
 	}
 
-	// "Auto" override
-	if override == "auto" {
-		virtualMemoryStat, err := mem.VirtualMemoryWithContext(ctx)
-		if err != nil {
-			return 0, err
+	// Expose GitLab job environment variables to the script
+	for _, keyAndValue := range os.Environ() {
+		keyAndValue, found := strings.CutPrefix(keyAndValue, "CUSTOM_ENV_")
+		if !found {
+			// Doesn't look like a GitLab job environment variable
+			continue
 		}
 
-		return virtualMemoryStat.Total / uint64(units.MiB) / concurrency, nil
+		key, value, _ := strings.Cut(keyAndValue, "=")
+
+		if _, err := fmt.Fprintf(stdinBuf, "export %s=%s\n", key, shell.Quote(value)); err != nil {
+			return err
+		}
 	}
 
-	// Exact override
-	return strconv.ParseUint(override, 10, 64)
-}
+	// Run the script itself
+	if _, err := stdinBuf.Write([]byte(script)); err != nil {
+		return err
+	}
 
-func installGitlabRunnerScript(installGitlabRunner string) (string, error) {
-	switch installGitlabRunner {
-	case "brew":
-		return installGitlabRunnerBrewScript, nil
-	case "curl":
-		return installGitlabRunnerCurlScript, nil
-	case "true", "yes", "on":
-		log.Printf("%q value for TART_EXECUTOR_INSTALL_GITLAB_RUNNER will deprecated "+
-			"in next version, please use either \"brew\", \"curl\" or \"major.minor.patch\"",
-			installGitlabRunner)
-
-		return installGitlabRunnerScriptAuto, nil
-	case "":
-		return "", nil
-	default:
-		version, err := semver.NewVersion(installGitlabRunner)
-		if err == nil {
-			return strings.ReplaceAll(installGitlabRunnerCurlScript, "${GITLAB_RUNNER_VERSION}",
-				"v"+version.String()), nil
+	if err := stdinBuf.Close(); err != nil {
+		return err
+	}
+
+	if err := session.Wait(); err != nil {
+		if ctxErr := context.Cause(ctx); ctxErr != nil {
+			return ctxErr
 		}
 
-		return "", fmt.Errorf("%w: TART_EXECUTOR_INSTALL_GITLAB_RUNNER only accepts "+
-			"\"brew\", \"curl\" or \"major.minor.patch\", got %q", ErrFailed, installGitlabRunner)
+		return err
 	}
-}
 
-func quote(s string) string {
-	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	return nil
 }
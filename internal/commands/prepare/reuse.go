@@ -0,0 +1,124 @@
+package prepare
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/admission"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/gitlab"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/reuse"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"golang.org/x/crypto/ssh"
+)
+
+// acquireReuseLease returns a lease on the VM kept between the jobs
+// of the current project, or nil if the VM reuse is not enabled for
+// the project or the VM is currently used by another job.
+//
+//nolint:nilnil // not being able to reuse a VM is not an error
+func acquireReuseLease(ctx context.Context, gitLabEnv *gitlab.Env) (*reuse.Lease, error) {
+	if gitLabEnv.ProjectPath == "" {
+		return nil, nil
+	}
+
+	enabled, err := matchAny(reuseProjectPatterns, gitLabEnv.ProjectPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+
+	// Otherwise any project could claim to be the trusted one
+	// and get its VM along with whatever the previous jobs left there
+	if !gitLabEnv.ProjectVerified {
+		log.Println("Not reusing the VM kept for this project since its path can't be verified, " +
+			"pass --gitlab-url to verify it")
+
+		return nil, nil
+	}
+
+	lease, err := reuse.Acquire(ctx, tart.DefaultBackend, gitLabEnv.JobImage, gitLabEnv.ProjectPath, gitLabEnv.JobID)
+	if err != nil {
+		return nil, err
+	}
+
+	if lease == nil {
+		log.Println("The VM kept for this project is used by another job, cloning a new VM...")
+	}
+
+	return lease, nil
+}
+
+// startReusedVM starts the VM kept from the previous jobs, if any,
+// and returns nil if a new VM needs to be cloned instead.
+//
+//nolint:nilnil // not having a VM to reuse is not an error
+func startReusedVM(
+	ctx context.Context,
+	lease *reuse.Lease,
+	gitLabEnv *gitlab.Env,
+	config tart.Config,
+	cpuOverride uint64,
+	memoryOverride uint64,
+) (*tart.VM, error) {
+	if lease.Jobs == 0 {
+		return nil, nil
+	}
+
+	vm := tart.ExistingVMByName(tart.DefaultBackend, lease.VMName)
+
+	if lease.Expired(reuseMaxJobs, reuseMaxAge) {
+		log.Printf("VM %s kept from the previous jobs has expired, deleting it...\n", lease.VMName)
+
+		if err := vm.Delete(); err != nil {
+			log.Printf("Failed to delete VM %s: %v\n", lease.VMName, err)
+		}
+
+		lease.Reset()
+
+		return nil, nil
+	}
+
+	log.Printf("Reusing VM %s kept from the previous jobs...\n", lease.VMName)
+
+	if err := vm.Rename(ctx, gitLabEnv.VirtualMachineID()); err != nil {
+		log.Printf("Failed to reuse VM %s, cloning a new VM: %v\n", lease.VMName, err)
+
+		lease.Reset()
+
+		return nil, nil
+	}
+
+	if err := vm.Configure(ctx, config, cpuOverride, memoryOverride); err != nil {
+		return nil, err
+	}
+
+	if err := admission.Admit(ctx, tart.DefaultBackend, vm.Name(), admissionOptions()); err != nil {
+		return nil, err
+	}
+
+	if err := vm.Start(ctx, config, gitLabEnv, customDirectoryMounts, customDiskMounts,
+		nested, tartRunEnv); err != nil {
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+func resetReusedVM(ctx context.Context, sshClient *ssh.Client) error {
+	if reuseResetScriptPath == "" {
+		return nil
+	}
+
+	log.Println("Resetting the reused VM...")
+
+	resetScript, err := os.ReadFile(reuseResetScriptPath)
+	if err != nil {
+		return err
+	}
+
+	return runScriptInGuest(ctx, sshClient, string(resetScript))
+}
@@ -3,9 +3,15 @@ package commands
 import (
 	"github.com/cirruslabs/gitlab-tart-executor/internal/commands/cleanup"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/commands/config"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/commands/gc"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/commands/localnetworkhelper"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/commands/pool"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/commands/prepare"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/commands/run"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/configfile"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/eventlog"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/metrics"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/version"
 	"github.com/spf13/cobra"
 )
@@ -16,6 +22,12 @@ func NewRootCmd() *cobra.Command {
 		SilenceUsage:  true,
 		SilenceErrors: true,
 		Version:       version.FullVersion,
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+			eventlog.SetStage(cmd.Name())
+			eventlog.Subscribe(metrics.Observe)
+
+			return configfile.Apply(cmd)
+		},
 	}
 
 	command.AddCommand(
@@ -23,8 +35,15 @@ func NewRootCmd() *cobra.Command {
 		prepare.NewCommand(),
 		run.NewCommand(),
 		cleanup.NewCommand(),
+		gc.NewCommand(),
 		localnetworkhelper.NewCommand(),
+		pool.NewCommand(),
 	)
 
+	statedir.IntroduceFlag(command)
+	eventlog.IntroduceFlag(command)
+	metrics.IntroduceFlag(command)
+	configfile.IntroduceFlag(command)
+
 	return command
 }
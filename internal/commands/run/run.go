@@ -3,24 +3,56 @@ package run
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/cirruslabs/gitlab-tart-executor/internal/eventlog"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/gitlab"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/imagealias"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/localnetworkhelper"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/metrics"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/shell"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/ssh"
 )
 
+var sshKnownHosts []string
+var ipTimeout time.Duration
+var bootTimeout time.Duration
+var sshRetryDelay time.Duration
+
 func NewCommand() *cobra.Command {
 	command := &cobra.Command{
 		Use:   "run <path-to-script-file>",
 		Short: "Run GitLab's scripts in a Tart VM",
-		RunE:  runScriptInsideVM,
-		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := runScriptInsideVM(cmd, args)
+
+			eventlog.Finish(err)
+			metrics.Flush()
+
+			return err
+		},
+		Args: cobra.MinimumNArgs(1),
 	}
 
+	command.PersistentFlags().StringArrayVar(&sshKnownHosts, "ssh-known-hosts", []string{},
+		"path to a known_hosts file to verify the VM's SSH host key against instead of the "+
+			"host key pinned in \"prepare\" stage, can be specified multiple times")
+	command.PersistentFlags().DurationVar(&ipTimeout, "ip-timeout", tart.DefaultIPTimeout,
+		"how long to wait for the VM to obtain an IP address in a single \"tart ip\" invocation "+
+			"(can be overridden by the job using the TART_EXECUTOR_IP_TIMEOUT variable)")
+	command.PersistentFlags().DurationVar(&bootTimeout, "boot-timeout", tart.DefaultBootTimeout,
+		"how long to wait for the VM to become SSH-able before failing the job "+
+			"(can be overridden by the job using the TART_EXECUTOR_BOOT_TIMEOUT variable)")
+	command.PersistentFlags().DurationVar(&sshRetryDelay, "ssh-retry-delay", tart.DefaultSSHRetryDelay,
+		"delay between the attempts to obtain the VM's IP address and to connect to it via SSH "+
+			"(can be overridden by the job using the TART_EXECUTOR_SSH_RETRY_DELAY variable)")
+
 	localnetworkhelper.IntroduceFlag(command)
 
 	return command
@@ -42,7 +74,9 @@ func runScriptInsideVM(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	vm := tart.ExistingVM(*gitLabEnv)
+	eventlog.SetJob(gitLabEnv.JobID, gitLabEnv.JobImage)
+
+	vm := tart.ExistingVM(tart.DefaultBackend, *gitLabEnv)
 
 	// Monitor "tart run" command's output so it's not silenced
 	go vm.MonitorTartRunOutput()
@@ -52,10 +86,18 @@ func runScriptInsideVM(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	sshClient, err := vm.OpenSSH(cmd.Context(), config, dialer)
+	config.SetDefaultTimeouts(ipTimeout, bootTimeout, sshRetryDelay)
+
+	hostKeyCallback, err := vm.HostKeyCallback(sshKnownHosts, false)
 	if err != nil {
 		return err
 	}
+
+	sshClient, err := vm.OpenSSH(cmd.Context(), config, dialer, hostKeyCallback)
+	if err != nil {
+		// The script didn't even start, so it's not the job's fault
+		return gitlab.NewSystemFailureError(err)
+	}
 	defer sshClient.Close()
 
 	sshSession, err := sshClient.NewSession()
@@ -65,28 +107,45 @@ func runScriptInsideVM(cmd *cobra.Command, args []string) error {
 	defer sshSession.Close()
 
 	// GitLab script ends with an `exit` command which will terminate the SSH session
-	sshSession.Stdin = scriptFile
+	var script io.Reader = scriptFile
+
+	// Let the job know which image its alias resolved to
+	if image, ok := os.LookupEnv(imagealias.EnvResolvedImage); ok {
+		script = io.MultiReader(strings.NewReader(fmt.Sprintf("export %s=%s\n",
+			imagealias.EnvResolvedImage, shell.Quote(image))), script)
+	}
+
+	sshSession.Stdin = script
 	sshSession.Stdout = os.Stdout
 	sshSession.Stderr = os.Stderr
 
+	step := eventlog.Begin("script", vm.Name())
+
 	if config.Shell != "" {
 		err = sshSession.Start(config.Shell)
 	} else {
 		err = sshSession.Shell()
 	}
 	if err != nil {
+		step.End(err)
+
 		return err
 	}
 
 	if err = sshSession.Wait(); err != nil {
 		var sshExitError *ssh.ExitError
 		if errors.As(err, &sshExitError) {
+			step.EndWithExitCode(sshExitError.ExitStatus(), err)
 			propagateSSHExitError(sshExitError)
+		} else {
+			step.End(err)
 		}
 
 		return err
 	}
 
+	step.EndWithExitCode(0, nil)
+
 	return nil
 }
 
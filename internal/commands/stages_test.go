@@ -0,0 +1,211 @@
+package commands_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/commands"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+const image = "ghcr.io/cirruslabs/macos-sonoma-base:latest"
+
+// TestStages runs the "prepare", "run" and "cleanup" stages against
+// the fake Tart backend, with the "guest" being an in-process SSH server
+// that runs the commands on the host.
+func TestStages(t *testing.T) {
+	backend := tart.NewFakeBackend()
+
+	previousBackend := tart.DefaultBackend
+	tart.DefaultBackend = backend
+	t.Cleanup(func() {
+		tart.DefaultBackend = previousBackend
+	})
+
+	stateDir := t.TempDir()
+	guestDir := t.TempDir()
+
+	t.Setenv("TMPDIR", t.TempDir())
+	t.Setenv("CUSTOM_ENV_CI_JOB_ID", "42")
+	t.Setenv("CUSTOM_ENV_CI_JOB_IMAGE", image)
+	t.Setenv("CUSTOM_ENV_TART_EXECUTOR_SSH_PORT", strconv.Itoa(startSSHServer(t)))
+
+	stage := func(args ...string) error {
+		command := commands.NewRootCmd()
+		command.SetArgs(append([]string{"--state-dir", stateDir}, args...))
+
+		return command.ExecuteContext(context.Background())
+	}
+
+	require.NoError(t, stage("prepare", "--cpu", "4", "--memory", "8192"))
+
+	fakeVM, ok := backend.VM("gitlab-42")
+	require.True(t, ok)
+	require.Equal(t, image, fakeVM.Source)
+	require.EqualValues(t, 4, fakeVM.CPU)
+	require.EqualValues(t, 8192, fakeVM.Memory)
+	require.True(t, fakeVM.Running)
+
+	// The script runs in the "guest"
+	markerPath := filepath.Join(guestDir, "marker")
+
+	require.NoError(t, stage("run", writeScript(t, "echo \"$0\" > "+markerPath+"\nexit 0\n")))
+
+	markerBytes, err := os.ReadFile(markerPath)
+	require.NoError(t, err)
+	require.NotEmpty(t, markerBytes)
+
+	// The script's exit code is propagated to GitLab Runner
+	exitCodePath := filepath.Join(t.TempDir(), "exit-code")
+	t.Setenv("BUILD_EXIT_CODE_FILE", exitCodePath)
+
+	var exitError *ssh.ExitError
+
+	require.ErrorAs(t, stage("run", writeScript(t, "exit 3\n")), &exitError)
+
+	exitCodeBytes, err := os.ReadFile(exitCodePath)
+	require.NoError(t, err)
+	require.Equal(t, "3\n", string(exitCodeBytes))
+
+	require.NoError(t, stage("cleanup"))
+
+	_, ok = backend.VM("gitlab-42")
+	require.False(t, ok)
+}
+
+func writeScript(t *testing.T, script string) string {
+	scriptPath := filepath.Join(t.TempDir(), "script.sh")
+
+	require.NoError(t, os.WriteFile(scriptPath, []byte(script), 0600))
+
+	return scriptPath
+}
+
+// startSSHServer starts an SSH server on the fake backend's IP address
+// that accepts the default credentials and returns its port.
+func startSSHServer(t *testing.T) int {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	require.NoError(t, err)
+
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() != "admin" || string(password) != "admin" {
+				return nil, errors.New("invalid credentials")
+			}
+
+			return &ssh.Permissions{}, nil
+		},
+	}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveSSH(netConn, serverConfig)
+		}
+	}()
+
+	tcpAddr, ok := listener.Addr().(*net.TCPAddr)
+	require.True(t, ok)
+
+	return tcpAddr.Port
+}
+
+func serveSSH(netConn net.Conn, serverConfig *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(netConn, serverConfig)
+	if err != nil {
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go serveSession(channel, requests)
+	}
+}
+
+func serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for request := range requests {
+		var cmd *exec.Cmd
+
+		switch request.Type {
+		case "shell":
+			cmd = exec.Command("sh", "-s")
+		case "exec":
+			var payload struct {
+				Command string
+			}
+
+			if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+				_ = request.Reply(false, nil)
+
+				continue
+			}
+
+			cmd = exec.Command("sh", "-c", payload.Command) //nolint:gosec // that's what the guest does
+		default:
+			_ = request.Reply(false, nil)
+
+			continue
+		}
+
+		_ = request.Reply(true, nil)
+
+		cmd.Stdin = channel
+		cmd.Stdout = channel
+		cmd.Stderr = channel.Stderr()
+
+		exitStatus := 0
+
+		if err := cmd.Run(); err != nil {
+			var exitErr *exec.ExitError
+
+			if !errors.As(err, &exitErr) {
+				exitStatus = 255
+			} else {
+				exitStatus = exitErr.ExitCode()
+			}
+		}
+
+		_, _ = channel.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, uint32(exitStatus)))
+
+		return
+	}
+}
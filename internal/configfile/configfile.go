@@ -0,0 +1,163 @@
+package configfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const EnvConfigFile = "TART_EXECUTOR_CONFIG_FILE"
+
+// The only keys in the configuration file
+// that don't correspond to command-line arguments.
+const (
+	defaultsKey = "defaults"
+	policyKey   = "policy"
+)
+
+const defaultsPrefix = "TART_EXECUTOR_"
+
+var (
+	ErrInvalid = errors.New("invalid configuration file")
+
+	errSingleValue = errors.New("only a single value is supported")
+)
+
+var path string
+
+var defaults map[string]string
+
+func IntroduceFlag(command *cobra.Command) {
+	command.PersistentFlags().StringVar(&path, "config-file", os.Getenv(EnvConfigFile),
+		"path to a YAML file with the values for the command-line arguments of all commands and "+
+			"the defaults for the TART_EXECUTOR_* variables (can also be set via the "+EnvConfigFile+
+			" environment variable)")
+}
+
+// Apply sets the command-line arguments of the command that were not explicitly
+// specified to the values from the configuration file, if any.
+//
+// The configuration file is shared between all commands, so the keys
+// that correspond to the command-line arguments of other commands are ignored.
+func Apply(command *cobra.Command) error {
+	if path == "" {
+		return nil
+	}
+
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]any
+
+	if err := yaml.Unmarshal(fileBytes, &values); err != nil {
+		return fmt.Errorf("%w %s: %v", ErrInvalid, path, err)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if key == defaultsKey {
+			if err := parseDefaults(values[key]); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if key == policyKey {
+			if err := parsePolicy(values[key]); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if !isKnownFlag(command.Root(), key) {
+			return fmt.Errorf("%w %s: %q doesn't correspond to any command-line argument", ErrInvalid, path, key)
+		}
+
+		flag := command.Flags().Lookup(key)
+		if flag == nil || flag.Changed {
+			continue
+		}
+
+		if err := setFlag(flag, values[key]); err != nil {
+			return fmt.Errorf("%w %s: %q: %v", ErrInvalid, path, key, err)
+		}
+	}
+
+	return nil
+}
+
+// Defaults returns the defaults for the TART_EXECUTOR_* variables
+// from the configuration file that was applied, if any.
+func Defaults() map[string]string {
+	return defaults
+}
+
+func parseDefaults(value any) error {
+	mapping, ok := value.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%w %s: %q should be a mapping", ErrInvalid, path, defaultsKey)
+	}
+
+	defaults = map[string]string{}
+
+	for key, value := range mapping {
+		if !strings.HasPrefix(key, defaultsPrefix) {
+			return fmt.Errorf("%w %s: %q in %q should start with %q", ErrInvalid, path, key,
+				defaultsKey, defaultsPrefix)
+		}
+
+		defaults[key] = fmt.Sprint(value)
+	}
+
+	return nil
+}
+
+func setFlag(flag *pflag.Flag, value any) error {
+	list, isList := value.([]any)
+
+	sliceValue, isSlice := flag.Value.(pflag.SliceValue)
+
+	switch {
+	case isList && isSlice:
+		var strs []string
+
+		for _, item := range list {
+			strs = append(strs, fmt.Sprint(item))
+		}
+
+		return sliceValue.Replace(strs)
+	case isList:
+		return errSingleValue
+	default:
+		return flag.Value.Set(fmt.Sprint(value))
+	}
+}
+
+func isKnownFlag(command *cobra.Command, name string) bool {
+	if command.Flags().Lookup(name) != nil || command.PersistentFlags().Lookup(name) != nil {
+		return true
+	}
+
+	for _, subcommand := range command.Commands() {
+		if isKnownFlag(subcommand, name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,175 @@
+package configfile_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/configfile"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApply(t *testing.T) {
+	configFilePath := filepath.Join(t.TempDir(), "config.yml")
+
+	require.NoError(t, os.WriteFile(configFilePath, []byte(`
+cpu: auto
+concurrency: 2
+allow-image:
+  - ghcr.io/cirruslabs/*
+  - registry.example.com/*
+builds-dir: /Users/admin/builds
+defaults:
+  TART_EXECUTOR_SOFTNET: true
+  TART_EXECUTOR_SSH_USERNAME: runner
+`), 0600))
+
+	var cpu string
+	var concurrency uint64
+	var allowedImages []string
+
+	command := newCommand(&cpu, &concurrency, &allowedImages)
+	command.SetArgs([]string{"prepare", "--config-file", configFilePath, "--concurrency", "4"})
+	require.NoError(t, command.Execute())
+
+	require.Equal(t, "auto", cpu)
+	require.EqualValues(t, 4, concurrency, "command-line arguments take precedence")
+	require.Equal(t, []string{"ghcr.io/cirruslabs/*", "registry.example.com/*"}, allowedImages)
+
+	// Job variables take precedence over the defaults
+	t.Setenv("CUSTOM_ENV_TART_EXECUTOR_SSH_USERNAME", "admin")
+
+	config, err := tart.NewConfigFromEnvironment()
+	require.NoError(t, err)
+	require.True(t, config.Softnet)
+	require.Equal(t, "admin", config.SSHUsername)
+}
+
+func TestApplyUnknownKey(t *testing.T) {
+	configFilePath := filepath.Join(t.TempDir(), "config.yml")
+
+	require.NoError(t, os.WriteFile(configFilePath, []byte("cpus: auto\n"), 0600))
+
+	var cpu string
+	var concurrency uint64
+	var allowedImages []string
+
+	command := newCommand(&cpu, &concurrency, &allowedImages)
+	command.SetArgs([]string{"prepare", "--config-file", configFilePath})
+	require.ErrorIs(t, command.Execute(), configfile.ErrInvalid)
+}
+
+func newCommand(cpu *string, concurrency *uint64, allowedImages *[]string) *cobra.Command {
+	command := &cobra.Command{
+		Use:          "executor",
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+			return configfile.Apply(cmd)
+		},
+	}
+
+	prepareCommand := &cobra.Command{
+		Use: "prepare",
+		RunE: func(*cobra.Command, []string) error {
+			return nil
+		},
+	}
+	prepareCommand.Flags().StringVar(cpu, "cpu", "", "")
+	prepareCommand.Flags().Uint64Var(concurrency, "concurrency", 1, "")
+	prepareCommand.Flags().StringArrayVar(allowedImages, "allow-image", []string{}, "")
+
+	configCommand := &cobra.Command{
+		Use: "config",
+	}
+	configCommand.Flags().String("builds-dir", "", "")
+
+	command.AddCommand(prepareCommand, configCommand)
+	configfile.IntroduceFlag(command)
+
+	return command
+}
+
+func TestPolicy(t *testing.T) {
+	configFilePath := filepath.Join(t.TempDir(), "config.yml")
+
+	require.NoError(t, os.WriteFile(configFilePath, []byte(`
+policy:
+  default: deny
+  variables:
+    TART_EXECUTOR_SSH_USERNAME: allow
+    TART_EXECUTOR_BRIDGED: deny
+    TART_EXECUTOR_SOFTNET:
+      force: "true"
+    TART_EXECUTOR_SOFTNET_ALLOW:
+      values: ["10.0.0.0/8", "192.168.0.0/16"]
+`), 0600))
+
+	var cpu string
+	var concurrency uint64
+	var allowedImages []string
+
+	command := newCommand(&cpu, &concurrency, &allowedImages)
+	command.SetArgs([]string{"prepare", "--config-file", configFilePath})
+	require.NoError(t, command.Execute())
+
+	t.Setenv("CUSTOM_ENV_TART_EXECUTOR_SSH_USERNAME", "runner")
+	t.Setenv("CUSTOM_ENV_TART_EXECUTOR_SOFTNET_ALLOW", "10.0.0.0/8")
+
+	// Forced values are used even if not set by the job
+	config, err := tart.NewConfigFromEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, "runner", config.SSHUsername)
+	require.True(t, config.Softnet)
+	require.Equal(t, "10.0.0.0/8", config.SoftnetAllow)
+
+	for key, value := range map[string]string{
+		"CUSTOM_ENV_TART_EXECUTOR_BRIDGED":       "en0",
+		"CUSTOM_ENV_TART_EXECUTOR_INSECURE_PULL": "true",
+		"CUSTOM_ENV_TART_EXECUTOR_SOFTNET":       "false",
+		"CUSTOM_ENV_TART_EXECUTOR_SOFTNET_ALLOW": "0.0.0.0/0",
+	} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+
+			_, err := tart.NewConfigFromEnvironment()
+			require.ErrorIs(t, err, tart.ErrPolicyViolation)
+		})
+	}
+}
+
+func TestPolicyOperatorOnlyVariables(t *testing.T) {
+	configFilePath := filepath.Join(t.TempDir(), "config.yml")
+
+	require.NoError(t, os.WriteFile(configFilePath, []byte(`
+defaults:
+  TART_EXECUTOR_SSH_PRIVATE_KEY_FILE: /etc/tart-executor/id_ed25519
+policy:
+  variables:
+    TART_EXECUTOR_SSH_AGENT: allow
+`), 0600))
+
+	var cpu string
+	var concurrency uint64
+	var allowedImages []string
+
+	command := newCommand(&cpu, &concurrency, &allowedImages)
+	command.SetArgs([]string{"prepare", "--config-file", configFilePath})
+	require.NoError(t, command.Execute())
+
+	// The operator can still set them using the defaults
+	// and allow the jobs to set them explicitly
+	t.Setenv("CUSTOM_ENV_TART_EXECUTOR_SSH_AGENT", "true")
+
+	config, err := tart.NewConfigFromEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, "/etc/tart-executor/id_ed25519", config.SSHPrivateKeyFile)
+	require.True(t, config.SSHAgent)
+
+	// Even though the policy allows all other variables by default
+	t.Setenv("CUSTOM_ENV_TART_EXECUTOR_SSH_PRIVATE_KEY_FILE", "/etc/passwd")
+
+	_, err = tart.NewConfigFromEnvironment()
+	require.ErrorIs(t, err, tart.ErrPolicyViolation)
+}
@@ -0,0 +1,98 @@
+package configfile
+
+import (
+	"bytes"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// Policy restricts which TART_EXECUTOR_* variables the jobs may set.
+type Policy struct {
+	// Default is either PolicyAllow (the default) or PolicyDeny,
+	// and applies to the variables not listed in Variables.
+	Default string `yaml:"default"`
+
+	Variables map[string]VariableRule `yaml:"variables"`
+}
+
+// VariableRule is either a PolicyAllow or PolicyDeny scalar,
+// or a mapping with either a forced value or the allowed values.
+type VariableRule struct {
+	Allow bool `yaml:"-"`
+
+	// Force is the value that is used when the job doesn't set the
+	// variable, the job may only set the variable to the same value
+	Force *string `yaml:"force"`
+
+	// Values are the doublestar-compatible patterns
+	// that the value set by the job needs to match
+	Values []string `yaml:"values"`
+}
+
+var policy *Policy
+
+// GetPolicy returns the policy from the configuration
+// file that was applied, or nil if there's none.
+func GetPolicy() *Policy {
+	return policy
+}
+
+func (rule *VariableRule) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		switch node.Value {
+		case PolicyAllow:
+			rule.Allow = true
+		case PolicyDeny:
+			rule.Allow = false
+		default:
+			return fmt.Errorf("%w: expected %q or %q, got %q", ErrInvalid, PolicyAllow, PolicyDeny,
+				node.Value)
+		}
+
+		return nil
+	}
+
+	type plain VariableRule
+
+	if err := node.Decode((*plain)(rule)); err != nil {
+		return err
+	}
+
+	rule.Allow = true
+
+	return nil
+}
+
+func parsePolicy(value any) error {
+	// Re-encode the value to benefit from the strict decoding
+	policyBytes, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(policyBytes))
+	decoder.KnownFields(true)
+
+	var result Policy
+
+	if err := decoder.Decode(&result); err != nil {
+		return fmt.Errorf("%w %s: %q: %v", ErrInvalid, path, policyKey, err)
+	}
+
+	switch result.Default {
+	case "", PolicyAllow, PolicyDeny:
+	default:
+		return fmt.Errorf("%w %s: %q: default should be either %q or %q, got %q", ErrInvalid, path,
+			policyKey, PolicyAllow, PolicyDeny, result.Default)
+	}
+
+	policy = &result
+
+	return nil
+}
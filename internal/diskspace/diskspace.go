@@ -0,0 +1,355 @@
+package diskspace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+)
+
+var ErrInsufficientDiskSpace = errors.New("insufficient disk space")
+
+const gigabyte = 1000 * 1000 * 1000
+
+// FreeSpaceFunc returns the number of bytes available to the Tart.
+type FreeSpaceFunc func() (uint64, error)
+
+type Options struct {
+	// MinFree is the amount of free space in gigabytes
+	// to keep on the Tart home volume in addition to
+	// the space needed for pulling the image
+	MinFree uint64
+
+	// Budget, if not zero, is the maximum total size in gigabytes
+	// of the OCI images cached by the Tart, including the image
+	// that is being pulled
+	Budget uint64
+
+	// PullPolicy decides whether the image is going to be pulled,
+	// otherwise no space is needed for pulling it
+	PullPolicy tart.PullPolicy
+
+	// FreeSpace, if not nil, is used instead of
+	// checking the Tart home volume directly
+	FreeSpace FreeSpaceFunc
+}
+
+func (opts Options) Enabled() bool {
+	return opts.MinFree != 0 || opts.Budget != 0
+}
+
+// cachedImage is an image stored by the Tart along
+// with the tags that point to it, if any.
+type cachedImage struct {
+	tart.ListEntry
+
+	tags       []string
+	accessedAt time.Time
+}
+
+// Preflight makes sure that there's enough disk space to pull the image
+// by evicting the least recently used OCI images cached by the Tart,
+// and fails with ErrInsufficientDiskSpace if that wasn't enough.
+func Preflight(ctx context.Context, backend tart.Backend, image string, opts Options) error {
+	if !opts.Enabled() {
+		return nil
+	}
+
+	freeSpaceFunc := opts.FreeSpace
+	if freeSpaceFunc == nil {
+		freeSpaceFunc = tartHomeFreeSpace
+	}
+
+	freeSpace, err := freeSpaceFunc()
+	if err != nil {
+		return err
+	}
+
+	listEntries, err := backend.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	needsPull, err := opts.PullPolicy.NeedsPull(ctx, backend, image)
+	if err != nil {
+		return err
+	}
+
+	imageSize := estimateImageSize(listEntries, image)
+
+	// No space is needed for the image that is already present
+	var pullSize uint64
+	if needsPull {
+		pullSize = imageSize
+	}
+
+	required := (opts.MinFree + pullSize) * gigabyte
+
+	// Candidates for eviction, from the least recently used
+	cachedImages := evictionCandidates(ctx, backend, listEntries, image)
+
+	var cachedSize uint64
+
+	for _, cachedImage := range cachedImages {
+		cachedSize += storageSize(cachedImage.ListEntry)
+	}
+
+	overBudget := func() bool {
+		return opts.Budget != 0 && cachedSize+imageSize > opts.Budget
+	}
+
+	for _, cachedImage := range cachedImages {
+		if freeSpace >= required && !overBudget() {
+			break
+		}
+
+		if !evict(ctx, backend, cachedImage) {
+			continue
+		}
+
+		cachedSize -= storageSize(cachedImage.ListEntry)
+
+		if freeSpace, err = freeSpaceFunc(); err != nil {
+			return err
+		}
+	}
+
+	if freeSpace < required {
+		return fmt.Errorf("%w: need %d GB (%d GB for %s and %d GB to keep free), but only %d GB "+
+			"is available even after evicting the cached images", ErrInsufficientDiskSpace,
+			required/gigabyte, pullSize, image, opts.MinFree, freeSpace/gigabyte)
+	}
+
+	if overBudget() {
+		return fmt.Errorf("%w: %s (%d GB) doesn't fit into the image cache budget of %d GB "+
+			"even after evicting the cached images", ErrInsufficientDiskSpace, image, imageSize, opts.Budget)
+	}
+
+	return nil
+}
+
+// evictionCandidates returns the images that can be evicted, from the least
+// recently used. Tags are just links to the digests, which is where the images
+// are actually stored, so only the digests are evicted, along with their tags.
+func evictionCandidates(
+	ctx context.Context,
+	backend tart.Backend,
+	listEntries []tart.ListEntry,
+	image string,
+) []cachedImage {
+	// The digest that the image points to, if known
+	var pinnedImage string
+
+	if strings.Contains(image, "@") {
+		pinnedImage = image
+	}
+
+	tags := map[string][]string{}
+
+	for _, listEntry := range listEntries {
+		if listEntry.Source != "OCI" || isDigest(listEntry) {
+			continue
+		}
+
+		fqn, err := backend.FQN(ctx, listEntry.Name)
+		if err != nil {
+			log.Printf("Failed to resolve %s to a digest: %v\n", listEntry.Name, err)
+
+			continue
+		}
+
+		if listEntry.Name == image {
+			pinnedImage = fqn
+		}
+
+		tags[fqn] = append(tags[fqn], listEntry.Name)
+	}
+
+	var result []cachedImage
+
+	for _, listEntry := range listEntries {
+		if listEntry.Source != "OCI" || !isDigest(listEntry) || listEntry.Name == pinnedImage {
+			continue
+		}
+
+		// We can't tell which of the digests the image's tag will point to
+		if pinnedImage == "" && repositoryOf(listEntry.Name) == repositoryOf(image) {
+			continue
+		}
+
+		candidate := cachedImage{
+			ListEntry:  listEntry,
+			tags:       tags[listEntry.Name],
+			accessedAt: accessedAt(listEntry),
+		}
+
+		// The image might've been used by one of its tags more recently
+		for _, tagListEntry := range listEntries {
+			if tagListEntry.Source == "OCI" && slices.Contains(candidate.tags, tagListEntry.Name) {
+				candidate.accessedAt = latest(candidate.accessedAt, accessedAt(tagListEntry))
+			}
+		}
+
+		result = append(result, candidate)
+	}
+
+	slices.SortFunc(result, func(a, b cachedImage) int {
+		return a.accessedAt.Compare(b.accessedAt)
+	})
+
+	return result
+}
+
+// evict deletes the image along with its tags, unless it's
+// being pulled or used by another job on this host (see
+// tart.UseImage), and returns true if it was deleted.
+func evict(ctx context.Context, backend tart.Backend, cachedImage cachedImage) bool {
+	var imageLocks []*tart.ImageLock
+
+	defer func() {
+		for _, imageLock := range imageLocks {
+			imageLock.Unlock()
+		}
+	}()
+
+	for _, name := range append([]string{cachedImage.Name}, cachedImage.tags...) {
+		imageLock, err := tart.TryLockImage(name)
+		if err != nil {
+			log.Printf("Failed to lock image %s for eviction: %v\n", name, err)
+
+			return false
+		}
+
+		if imageLock == nil {
+			log.Printf("Not evicting image %s since it's being used by another job\n", cachedImage.Name)
+
+			return false
+		}
+
+		imageLocks = append(imageLocks, imageLock)
+	}
+
+	log.Printf("Evicting least recently used image %s (%d GB) to free up disk space...\n",
+		cachedImage.Name, cachedImage.Size)
+
+	for _, tag := range cachedImage.tags {
+		if err := backend.Delete(ctx, tag); err != nil {
+			log.Printf("Failed to evict image %s: %v\n", tag, err)
+		}
+	}
+
+	if err := backend.Delete(ctx, cachedImage.Name); err != nil {
+		log.Printf("Failed to evict image %s: %v\n", cachedImage.Name, err)
+
+		return false
+	}
+
+	return true
+}
+
+// estimateImageSize returns the size of the image in gigabytes if it's already
+// pulled, otherwise it falls back to the largest locally cached image from the
+// same repository (e.g. a different tag), since the image size can't be known
+// in advance without querying the registry.
+func estimateImageSize(listEntries []tart.ListEntry, image string) uint64 {
+	var result int
+
+	repository := repositoryOf(image)
+
+	for _, listEntry := range listEntries {
+		if listEntry.Source != "OCI" {
+			continue
+		}
+
+		if listEntry.Name == image {
+			return uint64(max(listEntry.Size, 0))
+		}
+
+		if repositoryOf(listEntry.Name) == repository {
+			result = max(result, listEntry.Size)
+		}
+	}
+
+	return uint64(result)
+}
+
+// storageSize returns the size of the image in gigabytes. Tart lists each
+// pulled image twice: by the tag, which is just a link, and by the digest,
+// which is where the image is actually stored, so only the latter is counted.
+func storageSize(listEntry tart.ListEntry) uint64 {
+	if !isDigest(listEntry) {
+		return 0
+	}
+
+	return uint64(max(listEntry.Size, 0))
+}
+
+func isDigest(listEntry tart.ListEntry) bool {
+	return strings.Contains(listEntry.Name, "@")
+}
+
+func repositoryOf(image string) string {
+	if before, _, ok := strings.Cut(image, "@"); ok {
+		return before
+	}
+
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i]
+	}
+
+	return image
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+func accessedAt(listEntry tart.ListEntry) time.Time {
+	// Images with unknown access time are evicted first
+	result, _ := listEntry.AccessedAt()
+
+	return result
+}
+
+func tartHomeFreeSpace() (uint64, error) {
+	path := os.Getenv("TART_HOME")
+	if path == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return 0, err
+		}
+
+		path = filepath.Join(homeDir, ".tart")
+	}
+
+	// Tart home might not exist yet, in which case
+	// it will be created on the same volume as its parent
+	for {
+		if _, err := os.Stat(path); err == nil || filepath.Dir(path) == path {
+			break
+		}
+
+		path = filepath.Dir(path)
+	}
+
+	var stat syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	//nolint:unconvert // the field types differ between the platforms
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,178 @@
+package diskspace_test
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/diskspace"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	diskSize = 100
+	gigabyte = 1000 * 1000 * 1000
+	image    = "ghcr.io/cirruslabs/macos-sequoia-base:latest"
+)
+
+func newBackend(t *testing.T) *tart.FakeBackend {
+	t.Helper()
+
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	backend := tart.NewFakeBackend()
+	backend.Digests["ghcr.io/cirruslabs/macos-sonoma-base:latest"] = "sha256:1"
+	backend.Digests["ghcr.io/cirruslabs/macos-sequoia-base:previous"] = "sha256:3"
+
+	for name, size := range map[string]int{
+		"ghcr.io/cirruslabs/macos-sonoma-base:latest":    30,
+		"ghcr.io/cirruslabs/macos-sonoma-base@sha256:1":  30,
+		"ghcr.io/cirruslabs/macos-ventura-base@sha256:2": 30,
+		"ghcr.io/cirruslabs/macos-sequoia-base:previous": 20,
+		"ghcr.io/cirruslabs/macos-sequoia-base@sha256:3": 20,
+	} {
+		require.NoError(t, backend.Pull(context.Background(), nil, name, tart.PullOptions{}))
+		backend.Sizes[name] = size
+	}
+
+	return backend
+}
+
+func freeSpace(backend *tart.FakeBackend) diskspace.FreeSpaceFunc {
+	return func() (uint64, error) {
+		listEntries, err := backend.List(context.Background())
+		if err != nil {
+			return 0, err
+		}
+
+		used := 0
+
+		for _, listEntry := range listEntries {
+			// Tags are just links to the digests
+			if listEntry.Source == "OCI" && strings.Contains(listEntry.Name, "@") {
+				used += listEntry.Size
+			}
+		}
+
+		return uint64(diskSize-used) * gigabyte, nil
+	}
+}
+
+func images(t *testing.T, backend *tart.FakeBackend) []string {
+	t.Helper()
+
+	listEntries, err := backend.List(context.Background())
+	require.NoError(t, err)
+
+	var result []string
+
+	for _, listEntry := range listEntries {
+		result = append(result, listEntry.Name)
+	}
+
+	return result
+}
+
+func TestPreflightEnoughSpace(t *testing.T) {
+	backend := newBackend(t)
+
+	// 20 GB free, 20 GB needed for the image (estimated from
+	// the other tag of the same repository) and 0 GB to keep free
+	require.NoError(t, diskspace.Preflight(context.Background(), backend, image, diskspace.Options{
+		Budget:    100,
+		FreeSpace: freeSpace(backend),
+	}))
+	require.Len(t, images(t, backend), 5)
+}
+
+func TestPreflightEviction(t *testing.T) {
+	backend := newBackend(t)
+
+	// 20 GB free, but 20 + 30 GB are needed
+	require.NoError(t, diskspace.Preflight(context.Background(), backend, image, diskspace.Options{
+		MinFree:   30,
+		FreeSpace: freeSpace(backend),
+	}))
+
+	free, err := freeSpace(backend)()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, free, uint64(50*gigabyte))
+
+	// The digest of the image being pulled might be the one that its tag points to
+	require.Contains(t, images(t, backend), "ghcr.io/cirruslabs/macos-sequoia-base@sha256:3")
+
+	// Tags are evicted along with their digests
+	require.Equal(t, slices.Contains(images(t, backend), "ghcr.io/cirruslabs/macos-sonoma-base@sha256:1"),
+		slices.Contains(images(t, backend), "ghcr.io/cirruslabs/macos-sonoma-base:latest"))
+}
+
+func TestPreflightEvictsTags(t *testing.T) {
+	backend := newBackend(t)
+
+	// 20 GB free, but 20 + 60 GB are needed
+	require.NoError(t, diskspace.Preflight(context.Background(), backend, image, diskspace.Options{
+		MinFree:   60,
+		FreeSpace: freeSpace(backend),
+	}))
+	require.ElementsMatch(t, []string{
+		"ghcr.io/cirruslabs/macos-sequoia-base:previous",
+		"ghcr.io/cirruslabs/macos-sequoia-base@sha256:3",
+	}, images(t, backend))
+}
+
+func TestPreflightImagePresent(t *testing.T) {
+	backend := newBackend(t)
+
+	// 20 GB free and 20 GB to keep free, since the image
+	// is present and isn't going to be pulled again
+	require.NoError(t, diskspace.Preflight(context.Background(), backend,
+		"ghcr.io/cirruslabs/macos-sequoia-base:previous", diskspace.Options{
+			MinFree:    20,
+			PullPolicy: tart.PullPolicy{Mode: tart.PullPolicyIfNotPresent},
+			FreeSpace:  freeSpace(backend),
+		}))
+	require.Len(t, images(t, backend), 5)
+}
+
+func TestPreflightImageInUse(t *testing.T) {
+	backend := newBackend(t)
+
+	// The least recently used image is being cloned by another job
+	imageLock, err := tart.UseImage("ghcr.io/cirruslabs/macos-sonoma-base:latest")
+	require.NoError(t, err)
+	defer imageLock.Unlock()
+
+	require.NoError(t, diskspace.Preflight(context.Background(), backend, image, diskspace.Options{
+		MinFree:   30,
+		FreeSpace: freeSpace(backend),
+	}))
+	require.Contains(t, images(t, backend), "ghcr.io/cirruslabs/macos-sonoma-base@sha256:1")
+	require.NotContains(t, images(t, backend), "ghcr.io/cirruslabs/macos-ventura-base@sha256:2")
+}
+
+func TestPreflightBudget(t *testing.T) {
+	backend := newBackend(t)
+
+	// 60 GB of the other images and 20 GB of the image being pulled
+	// don't fit into the 40 GB budget, so both other images are evicted
+	require.NoError(t, diskspace.Preflight(context.Background(), backend, image, diskspace.Options{
+		Budget:    40,
+		FreeSpace: freeSpace(backend),
+	}))
+	require.NotContains(t, images(t, backend), "ghcr.io/cirruslabs/macos-sonoma-base@sha256:1")
+	require.NotContains(t, images(t, backend), "ghcr.io/cirruslabs/macos-ventura-base@sha256:2")
+	require.Contains(t, images(t, backend), "ghcr.io/cirruslabs/macos-sequoia-base@sha256:3")
+}
+
+func TestPreflightInsufficientSpace(t *testing.T) {
+	backend := newBackend(t)
+
+	err := diskspace.Preflight(context.Background(), backend, image, diskspace.Options{
+		MinFree:   90,
+		FreeSpace: freeSpace(backend),
+	})
+	require.ErrorIs(t, err, diskspace.ErrInsufficientDiskSpace)
+}
@@ -0,0 +1,202 @@
+package eventlog
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const EnvEventLog = "TART_EXECUTOR_EVENT_LOG"
+
+const (
+	StatusStarted   = "started"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+var path string
+
+var (
+	mtx            sync.Mutex
+	stage          string
+	stageStartedAt time.Time
+	jobID          string
+	image          string
+	listeners      []func(Event)
+)
+
+// Event is a single line of the event log.
+type Event struct {
+	Time            time.Time `json:"time"`
+	Stage           string    `json:"stage,omitempty"`
+	Event           string    `json:"event"`
+	Status          string    `json:"status,omitempty"`
+	JobID           string    `json:"job_id,omitempty"`
+	VMName          string    `json:"vm_name,omitempty"`
+	Image           string    `json:"image,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds,omitempty"`
+	ExitCode        *int      `json:"exit_code,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+func IntroduceFlag(command *cobra.Command) {
+	command.PersistentFlags().StringVar(&path, "event-log", os.Getenv(EnvEventLog),
+		"path to a file to append the JSON lines describing each step of the stage to "+
+			"(can also be set via the "+EnvEventLog+" environment variable)")
+}
+
+// SetStage sets the stage that all the subsequent events belong to.
+func SetStage(name string) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	stage = name
+	stageStartedAt = time.Now()
+}
+
+// SetJob sets the job and the image that all the subsequent events belong to.
+func SetJob(id string, jobImage string) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	jobID = id
+	image = jobImage
+}
+
+// Subscribe calls the listener for each subsequent event,
+// regardless of whether the event log is enabled or not.
+func Subscribe(listener func(Event)) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	listeners = append(listeners, listener)
+}
+
+// Emit appends the event to the event log, if enabled.
+//
+// Failing to write an event is not fatal to the job,
+// so the errors are only logged.
+func Emit(event Event) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Stage == "" {
+		event.Stage = stage
+	}
+	if event.JobID == "" {
+		event.JobID = jobID
+	}
+	if event.Image == "" {
+		event.Image = image
+	}
+
+	for _, listener := range listeners {
+		listener(event)
+	}
+
+	if path == "" {
+		return
+	}
+
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to serialize event log entry: %v\n", err)
+
+		return
+	}
+
+	//nolint:gosec // G302 shouldn't apply here as the event log is meant to be read by other tools
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("Failed to open event log: %v\n", err)
+
+		return
+	}
+	defer file.Close()
+
+	// A single write of a single line, so that concurrently
+	// running stages don't interleave their events
+	if _, err := file.Write(append(eventBytes, '\n')); err != nil {
+		log.Printf("Failed to write to event log: %v\n", err)
+	}
+}
+
+// Finish emits the "stage" event that marks the end of the stage.
+func Finish(err error) {
+	mtx.Lock()
+	startedAt := stageStartedAt
+	mtx.Unlock()
+
+	event := Event{
+		Event:           "stage",
+		Status:          StatusSucceeded,
+		DurationSeconds: time.Since(startedAt).Seconds(),
+	}
+
+	if err != nil {
+		event.Status = StatusFailed
+		event.Error = err.Error()
+	}
+
+	Emit(event)
+}
+
+// Step measures the duration of a single step of the stage.
+type Step struct {
+	event     string
+	vmName    string
+	startedAt time.Time
+}
+
+// Begin emits the step's "started" event. Each step needs
+// to be finished by calling End or EndWithExitCode.
+func Begin(event string, vmName string) *Step {
+	step := &Step{
+		event:     event,
+		vmName:    vmName,
+		startedAt: time.Now(),
+	}
+
+	Emit(Event{
+		Time:   step.startedAt,
+		Event:  step.event,
+		Status: StatusStarted,
+		VMName: step.vmName,
+	})
+
+	return step
+}
+
+// End emits the step's "succeeded" or "failed" event, depending on the err.
+func (step *Step) End(err error) {
+	step.end(nil, err)
+}
+
+// EndWithExitCode is similar to End, but also records the exit code of a command.
+func (step *Step) EndWithExitCode(exitCode int, err error) {
+	step.end(&exitCode, err)
+}
+
+func (step *Step) end(exitCode *int, err error) {
+	event := Event{
+		Event:           step.event,
+		Status:          StatusSucceeded,
+		VMName:          step.vmName,
+		DurationSeconds: time.Since(step.startedAt).Seconds(),
+		ExitCode:        exitCode,
+	}
+
+	if err != nil {
+		event.Status = StatusFailed
+		event.Error = err.Error()
+	}
+
+	Emit(event)
+}
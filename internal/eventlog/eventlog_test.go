@@ -0,0 +1,62 @@
+package eventlog_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/eventlog"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSteps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	t.Setenv(eventlog.EnvEventLog, path)
+
+	eventlog.IntroduceFlag(&cobra.Command{})
+	eventlog.SetStage("run")
+	eventlog.SetJob("42", "ghcr.io/cirruslabs/macos-sonoma-base:latest")
+
+	eventlog.Begin("ssh", "gitlab-42").End(nil)
+	eventlog.Begin("script", "gitlab-42").EndWithExitCode(3, errors.New("exited with 3"))
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var events []eventlog.Event
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event eventlog.Event
+
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+
+		events = append(events, event)
+	}
+	require.NoError(t, scanner.Err())
+
+	require.Len(t, events, 4)
+
+	for _, event := range events {
+		require.Equal(t, "run", event.Stage)
+		require.Equal(t, "42", event.JobID)
+		require.Equal(t, "gitlab-42", event.VMName)
+		require.Equal(t, "ghcr.io/cirruslabs/macos-sonoma-base:latest", event.Image)
+	}
+
+	require.Equal(t, "ssh", events[0].Event)
+	require.Equal(t, eventlog.StatusStarted, events[0].Status)
+	require.Equal(t, eventlog.StatusSucceeded, events[1].Status)
+	require.Nil(t, events[1].ExitCode)
+
+	require.Equal(t, "script", events[3].Event)
+	require.Equal(t, eventlog.StatusFailed, events[3].Status)
+	require.Equal(t, "exited with 3", events[3].Error)
+	require.NotNil(t, events[3].ExitCode)
+	require.Equal(t, 3, *events[3].ExitCode)
+}
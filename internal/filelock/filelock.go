@@ -0,0 +1,72 @@
+package filelock
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// FileLock is an advisory lock on a file, which is used to synchronize
+// concurrently running executor invocations on the host.
+type FileLock struct {
+	file *os.File
+}
+
+// Lock blocks until the lock is acquired.
+func Lock(path string) (*FileLock, error) {
+	return lock(path, syscall.LOCK_EX)
+}
+
+// RLock blocks until the shared lock is acquired, which can be held
+// by multiple processes at once, but not along with the Lock().
+func RLock(path string) (*FileLock, error) {
+	return lock(path, syscall.LOCK_SH)
+}
+
+// TryLock acquires the lock without blocking and returns nil
+// if the lock is already held by somebody else.
+//
+//nolint:nilnil // the lock being busy is not an error
+func TryLock(path string) (*FileLock, error) {
+	fileLock, err := lock(path, syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return nil, nil
+	}
+
+	return fileLock, err
+}
+
+// TryRLock acquires the shared lock without blocking and returns nil
+// if the lock is already held exclusively by somebody else.
+//
+//nolint:nilnil // the lock being busy is not an error
+func TryRLock(path string) (*FileLock, error) {
+	fileLock, err := lock(path, syscall.LOCK_SH|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return nil, nil
+	}
+
+	return fileLock, err
+}
+
+func (fileLock *FileLock) Unlock() error {
+	// Closing the file releases the lock
+	return fileLock.file.Close()
+}
+
+func lock(path string, how int) (*FileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		_ = file.Close()
+
+		return nil, err
+	}
+
+	return &FileLock{
+		file: file,
+	}, nil
+}
@@ -0,0 +1,515 @@
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/gitlab"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/pool"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/reuse"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+)
+
+var ErrJobStatus = errors.New("failed to retrieve the job status")
+
+// JobStatusFunc reports whether the job is still
+// being worked on according to the GitLab.
+type JobStatusFunc func(ctx context.Context, jobID string, projectID string) (bool, error)
+
+// job is recorded by the "prepare" stage so that the
+// job status can be queried for the project it belongs to.
+type job struct {
+	ProjectID string `json:"project_id"`
+}
+
+type Options struct {
+	// MinAge protects the recently accessed VMs and host
+	// directories, for example, the ones that belong to
+	// a job that is in-between the stages.
+	MinAge time.Duration
+
+	// JobStatus, if not nil, is used to find the running VMs
+	// that belong to the jobs that are already finished.
+	JobStatus JobStatusFunc
+
+	// ReuseMaxJobs and ReuseMaxAge find the kept VMs that
+	// are expired (see reuse.Lease.Expired), zero means no limit
+	ReuseMaxJobs uint
+	ReuseMaxAge  time.Duration
+}
+
+// StaleVM is a job VM or a warm pool VM that is safe to delete.
+type StaleVM struct {
+	Name    string
+	JobID   string
+	Running bool
+	Reason  string
+
+	// PoolEntry is set for the warm pool VMs that are still in the pool
+	// and needs to be taken out of it before deleting the VM
+	PoolEntry *pool.Entry
+}
+
+// StaleVMs finds the job VMs that were not cleaned up, for example,
+// due to the GitLab Runner crash or the host reboot, and the warm
+// pool VMs that were left behind by the warm pool daemon.
+//
+// The job VMs that are used by the jobs holding the leases on the
+// kept VMs (see reuse.Lease) are left alone, since their "cleanup"
+// stage is yet to keep them for the subsequent jobs.
+//
+//nolint:gocognit // splitting this further would make it harder to follow
+func StaleVMs(ctx context.Context, backend tart.Backend, opts Options) ([]StaleVM, error) {
+	listEntries, err := backend.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	leases, err := reuse.List()
+	if err != nil {
+		return nil, err
+	}
+
+	poolEntries, err := pool.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []StaleVM
+
+	for _, listEntry := range listEntries {
+		if listEntry.Source != "local" {
+			continue
+		}
+
+		if strings.HasPrefix(listEntry.Name, pool.VMNamePrefix) {
+			if staleVM, ok := stalePoolVM(listEntry, poolEntries, opts); ok {
+				result = append(result, staleVM)
+			}
+
+			continue
+		}
+
+		jobID, ok := strings.CutPrefix(listEntry.Name, gitlab.VirtualMachineIDPrefix)
+		if !ok {
+			continue
+		}
+
+		if slices.ContainsFunc(leases, func(lease *reuse.Lease) bool {
+			return lease.JobID == jobID
+		}) {
+			continue
+		}
+
+		accessedAt, err := listEntry.AccessedAt()
+		if err != nil {
+			log.Printf("Skipping VM %s since its access time is unknown: %v\n", listEntry.Name, err)
+
+			continue
+		}
+
+		age := time.Since(accessedAt)
+		if age < opts.MinAge {
+			continue
+		}
+
+		staleVM := StaleVM{
+			Name:    listEntry.Name,
+			JobID:   jobID,
+			Running: listEntry.Running,
+		}
+
+		switch {
+		case !listEntry.Running:
+			staleVM.Reason = fmt.Sprintf("not running and last accessed %s ago", age.Round(time.Second))
+		case opts.JobStatus != nil:
+			active, err := opts.JobStatus(ctx, jobID, projectIDOf(jobID))
+			if err != nil {
+				log.Printf("Skipping VM %s: %v\n", listEntry.Name, err)
+
+				continue
+			}
+			if active {
+				continue
+			}
+
+			staleVM.Reason = fmt.Sprintf("job %s is finished", jobID)
+		default:
+			// A running VM might still be used by a job
+			continue
+		}
+
+		result = append(result, staleVM)
+	}
+
+	return result, nil
+}
+
+// stalePoolVM considers the warm pool VM stale when it's not in the pool
+// (e.g. the warm pool daemon was killed while booting it) or is no longer
+// running (e.g. after the host reboot while the warm pool daemon is not
+// running to discard it).
+func stalePoolVM(listEntry tart.ListEntry, poolEntries []pool.Entry, opts Options) (StaleVM, bool) {
+	staleVM := StaleVM{
+		Name:    listEntry.Name,
+		Running: listEntry.Running,
+	}
+
+	if i := slices.IndexFunc(poolEntries, func(poolEntry pool.Entry) bool {
+		return poolEntry.Name == listEntry.Name
+	}); i != -1 {
+		if listEntry.Running {
+			return StaleVM{}, false
+		}
+
+		staleVM.PoolEntry = &poolEntries[i]
+		staleVM.Reason = "warm pool VM is no longer running"
+
+		return staleVM, true
+	}
+
+	// The VM might be still booting or being claimed
+	accessedAt, err := listEntry.AccessedAt()
+	if err != nil || time.Since(accessedAt) < opts.MinAge {
+		return StaleVM{}, false
+	}
+
+	staleVM.Reason = "warm pool VM is not in the pool"
+
+	return staleVM, true
+}
+
+// StaleKeptVM is a VM kept between the jobs (see reuse.Lease) that is
+// safe to delete along with its lease, or a lease whose VM is gone.
+type StaleKeptVM struct {
+	Name    string
+	Running bool
+	Reason  string
+
+	// Lease is nil for the kept VMs that have no lease,
+	// otherwise the VM needs to be deleted using it
+	Lease *reuse.Lease
+}
+
+// StaleKeptVMs finds the kept VMs that are not leased by any job and are either
+// expired or were not used for MinAge, for example, when no more jobs arrive
+// for the project or the image now resolves to another digest.
+func StaleKeptVMs(ctx context.Context, backend tart.Backend, opts Options) ([]StaleKeptVM, error) {
+	listEntries, err := backend.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	leases, err := reuse.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []StaleKeptVM
+
+	for _, listEntry := range listEntries {
+		if listEntry.Source != "local" || !strings.HasPrefix(listEntry.Name, reuse.VMNamePrefix) {
+			continue
+		}
+
+		staleKeptVM := StaleKeptVM{
+			Name:    listEntry.Name,
+			Running: listEntry.Running,
+		}
+
+		accessedAt, err := listEntry.AccessedAt()
+		if err != nil {
+			log.Printf("Skipping VM %s since its access time is unknown: %v\n", listEntry.Name, err)
+
+			continue
+		}
+
+		i := slices.IndexFunc(leases, func(lease *reuse.Lease) bool {
+			return lease.VMName == listEntry.Name
+		})
+		if i == -1 {
+			// The VM might be still being created
+			age := time.Since(accessedAt)
+			if listEntry.Running || age < opts.MinAge {
+				continue
+			}
+
+			staleKeptVM.Reason = fmt.Sprintf("kept VM has no lease and was last accessed %s ago",
+				age.Round(time.Second))
+			result = append(result, staleKeptVM)
+
+			continue
+		}
+
+		lease := leases[i]
+		leases = slices.Delete(leases, i, i+1)
+
+		if lease.JobID != "" {
+			continue
+		}
+
+		lastUsedAt := accessedAt
+		for _, usedAt := range []time.Time{lease.LeasedAt, lease.CreatedAt} {
+			if usedAt.After(lastUsedAt) {
+				lastUsedAt = usedAt
+			}
+		}
+
+		idle := time.Since(lastUsedAt)
+
+		switch {
+		case lease.Expired(opts.ReuseMaxJobs, opts.ReuseMaxAge):
+			staleKeptVM.Reason = fmt.Sprintf("kept VM has run %d jobs and was created %s ago",
+				lease.Jobs, time.Since(lease.CreatedAt).Round(time.Second))
+		case idle >= opts.MinAge:
+			staleKeptVM.Reason = fmt.Sprintf("kept VM was not used for %s", idle.Round(time.Second))
+		default:
+			continue
+		}
+
+		staleKeptVM.Lease = lease
+		result = append(result, staleKeptVM)
+	}
+
+	// The leases left are the ones whose VMs are gone
+	for _, lease := range leases {
+		if lease.JobID != "" {
+			continue
+		}
+
+		result = append(result, StaleKeptVM{
+			Name:   lease.VMName,
+			Reason: "kept VM no longer exists",
+			Lease:  lease,
+		})
+	}
+
+	return result, nil
+}
+
+// OrphanedPoolEntries finds the warm pool entries whose VMs no longer exist.
+func OrphanedPoolEntries(ctx context.Context, backend tart.Backend) ([]pool.Entry, error) {
+	listEntries, err := backend.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	poolEntries, err := pool.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(poolEntries, func(poolEntry pool.Entry) bool {
+		return slices.ContainsFunc(listEntries, func(listEntry tart.ListEntry) bool {
+			return listEntry.Source == "local" && listEntry.Name == poolEntry.Name
+		})
+	}), nil
+}
+
+// RecordJob remembers the project of the job for the job status
+// queries (see NewJobStatusFunc), until ForgetJob() is called.
+func RecordJob(jobID string, projectID string) error {
+	if projectID == "" {
+		return nil
+	}
+
+	path, err := statedir.Path("jobs", jobID+".json")
+	if err != nil {
+		return err
+	}
+
+	jobBytes, err := json.Marshal(&job{ProjectID: projectID})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, jobBytes, 0600)
+}
+
+// ForgetJob removes the job recorded by RecordJob(), if any.
+func ForgetJob(jobID string) error {
+	path, err := statedir.Path("jobs", jobID+".json")
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// StaleJobs finds the jobs recorded by RecordJob() that
+// don't have a VM anymore and were recorded at least
+// opts.MinAge ago.
+func StaleJobs(jobIDs []string, opts Options) ([]string, error) {
+	dir, err := statedir.Dir("jobs")
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+
+	for _, path := range paths {
+		jobID := strings.TrimSuffix(filepath.Base(path), ".json")
+
+		if slices.Contains(jobIDs, jobID) {
+			continue
+		}
+
+		fileInfo, err := os.Stat(path)
+		if err != nil || time.Since(fileInfo.ModTime()) < opts.MinAge {
+			continue
+		}
+
+		result = append(result, jobID)
+	}
+
+	return result, nil
+}
+
+func projectIDOf(jobID string) string {
+	path, err := statedir.Path("jobs", jobID+".json")
+	if err != nil {
+		return ""
+	}
+
+	jobBytes, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	var result job
+
+	if err := json.Unmarshal(jobBytes, &result); err != nil {
+		return ""
+	}
+
+	return result.ProjectID
+}
+
+// JobIDs returns the IDs of the jobs that have a VM.
+func JobIDs(ctx context.Context, backend tart.Backend) ([]string, error) {
+	listEntries, err := backend.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+
+	for _, listEntry := range listEntries {
+		if listEntry.Source != "local" {
+			continue
+		}
+
+		if jobID, ok := strings.CutPrefix(listEntry.Name, gitlab.VirtualMachineIDPrefix); ok {
+			result = append(result, jobID)
+		}
+	}
+
+	return result, nil
+}
+
+// StaleHostDirs finds the host directories (see TART_EXECUTOR_HOST_DIR)
+// in the given temporary directories and in their immediate subdirectories
+// that belong to the jobs other than the given ones.
+func StaleHostDirs(tmpDirs []string, jobIDs []string, opts Options) ([]string, error) {
+	var result []string
+
+	for _, tmpDir := range tmpDirs {
+		// GitLab Runner uses a separate temporary directory for each job
+		for _, pattern := range []string{
+			filepath.Join(tmpDir, gitlab.HostDirPrefix+"*"),
+			filepath.Join(tmpDir, "*", gitlab.HostDirPrefix+"*"),
+		} {
+			paths, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, path := range paths {
+				jobID := strings.TrimPrefix(filepath.Base(path), gitlab.HostDirPrefix)
+
+				if slices.Contains(jobIDs, jobID) {
+					continue
+				}
+
+				fileInfo, err := os.Stat(path)
+				if err != nil || !fileInfo.IsDir() || time.Since(fileInfo.ModTime()) < opts.MinAge {
+					continue
+				}
+
+				result = append(result, path)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// NewJobStatusFunc queries the job status using the GitLab's "Get a single job"
+// API endpoint (or a compatible one), where the "{job_id}" and "{project_id}"
+// in the URL template are substituted with the job ID and its project ID.
+func NewJobStatusFunc(urlTemplate string, token string) JobStatusFunc {
+	return func(ctx context.Context, jobID string, projectID string) (bool, error) {
+		if strings.Contains(urlTemplate, "{project_id}") && projectID == "" {
+			return false, fmt.Errorf("%w for job %s: its project is unknown", ErrJobStatus, jobID)
+		}
+
+		url := strings.NewReplacer("{job_id}", jobID, "{project_id}", projectID).Replace(urlTemplate)
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return false, err
+		}
+
+		if token != "" {
+			request.Header.Set("PRIVATE-TOKEN", token)
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return false, fmt.Errorf("%w for job %s: %v", ErrJobStatus, jobID, err)
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+
+		if response.StatusCode != http.StatusOK {
+			return false, fmt.Errorf("%w for job %s: got HTTP %d", ErrJobStatus, jobID, response.StatusCode)
+		}
+
+		var job struct {
+			Status string `json:"status"`
+		}
+
+		if err := json.NewDecoder(response.Body).Decode(&job); err != nil {
+			return false, fmt.Errorf("%w for job %s: %v", ErrJobStatus, jobID, err)
+		}
+
+		switch job.Status {
+		case "created", "waiting_for_resource", "preparing", "pending", "running":
+			return true, nil
+		default:
+			return false, nil
+		}
+	}
+}
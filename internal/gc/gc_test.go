@@ -0,0 +1,236 @@
+package gc_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/gc"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/pool"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/reuse"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaleVMs(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+
+	const image = "ghcr.io/cirruslabs/macos-sonoma-base:latest"
+
+	for _, name := range []string{"gitlab-1", "gitlab-2", "gitlab-3", "tart-executor-reuse-abcdef"} {
+		require.NoError(t, backend.Clone(ctx, nil, image, name, tart.PullOptions{}))
+	}
+
+	require.NoError(t, backend.Run(ctx, "gitlab-2", tart.RunOptions{}))
+	require.NoError(t, backend.Run(ctx, "gitlab-3", tart.RunOptions{}))
+
+	// Running VMs are only considered stale when the job is known to be finished
+	staleVMs, err := gc.StaleVMs(ctx, backend, gc.Options{})
+	require.NoError(t, err)
+	require.Len(t, staleVMs, 1)
+	require.Equal(t, "gitlab-1", staleVMs[0].Name)
+	require.Equal(t, "1", staleVMs[0].JobID)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		require.Equal(t, "secret", request.Header.Get("PRIVATE-TOKEN"))
+
+		switch request.URL.Path {
+		case "/projects/7/jobs/2":
+			fmt.Fprint(writer, `{"status":"success"}`)
+		case "/projects/7/jobs/3":
+			fmt.Fprint(writer, `{"status":"running"}`)
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	jobStatus := gc.NewJobStatusFunc(server.URL+"/projects/{project_id}/jobs/{job_id}", "secret")
+
+	// The project of the job needs to be known
+	staleVMs, err = gc.StaleVMs(ctx, backend, gc.Options{JobStatus: jobStatus})
+	require.NoError(t, err)
+	require.Len(t, staleVMs, 1)
+
+	require.NoError(t, gc.RecordJob("2", "7"))
+	require.NoError(t, gc.RecordJob("3", "7"))
+
+	staleVMs, err = gc.StaleVMs(ctx, backend, gc.Options{JobStatus: jobStatus})
+	require.NoError(t, err)
+	require.Len(t, staleVMs, 2)
+	require.Equal(t, "gitlab-1", staleVMs[0].Name)
+	require.Equal(t, "gitlab-2", staleVMs[1].Name)
+	require.True(t, staleVMs[1].Running)
+
+	// Recently accessed VMs are left alone
+	staleVMs, err = gc.StaleVMs(ctx, backend, gc.Options{MinAge: time.Hour})
+	require.NoError(t, err)
+	require.Empty(t, staleVMs)
+}
+
+func TestStaleVMsLeasesAndPool(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+
+	const image = "ghcr.io/cirruslabs/macos-sonoma-base:latest"
+
+	for _, name := range []string{"gitlab-5", "tart-executor-pool-a", "tart-executor-pool-b", "tart-executor-pool-c"} {
+		require.NoError(t, backend.Clone(ctx, nil, image, name, tart.PullOptions{}))
+	}
+
+	require.NoError(t, backend.Run(ctx, "tart-executor-pool-a", tart.RunOptions{}))
+	require.NoError(t, backend.Run(ctx, "tart-executor-pool-c", tart.RunOptions{}))
+
+	// The job is yet to keep its VM in the "cleanup" stage
+	lease, err := reuse.Acquire(ctx, backend, image, "infra/ios-app", "5")
+	require.NoError(t, err)
+	require.NotNil(t, lease)
+
+	for _, name := range []string{"tart-executor-pool-a", "tart-executor-pool-b", "tart-executor-pool-d"} {
+		require.NoError(t, pool.Add(pool.Entry{Name: name, CreatedAt: time.Now()}))
+	}
+
+	staleVMs, err := gc.StaleVMs(ctx, backend, gc.Options{})
+	require.NoError(t, err)
+	require.Len(t, staleVMs, 2)
+	require.Equal(t, "tart-executor-pool-b", staleVMs[0].Name)
+	require.NotNil(t, staleVMs[0].PoolEntry)
+	require.Equal(t, "tart-executor-pool-c", staleVMs[1].Name)
+	require.Nil(t, staleVMs[1].PoolEntry)
+
+	orphanedPoolEntries, err := gc.OrphanedPoolEntries(ctx, backend)
+	require.NoError(t, err)
+	require.Len(t, orphanedPoolEntries, 1)
+	require.Equal(t, "tart-executor-pool-d", orphanedPoolEntries[0].Name)
+}
+
+func TestStaleKeptVMs(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+
+	const image = "ghcr.io/cirruslabs/macos-sonoma-base:latest"
+
+	keep := func(project string, jobs uint) *reuse.Lease {
+		lease, err := reuse.Acquire(ctx, backend, image, project, "1")
+		require.NoError(t, err)
+		require.NotNil(t, lease)
+		require.NoError(t, backend.Clone(ctx, nil, image, lease.VMName, tart.PullOptions{}))
+
+		lease.Reset()
+		lease.Jobs = jobs
+		require.NoError(t, lease.Release())
+
+		return lease
+	}
+
+	recent := keep("infra/recent", 1)
+	expired := keep("infra/expired", 50)
+	gone := keep("infra/gone", 1)
+	require.NoError(t, backend.Delete(ctx, gone.VMName))
+
+	// Leased VMs are left alone
+	leased := keep("infra/leased", 50)
+	_, err := reuse.Acquire(ctx, backend, image, "infra/leased", "2")
+	require.NoError(t, err)
+
+	// A kept VM whose lease is gone
+	require.NoError(t, backend.Clone(ctx, nil, image, reuse.VMNamePrefix+"orphaned", tart.PullOptions{}))
+
+	names := func(staleKeptVMs []gc.StaleKeptVM) []string {
+		var result []string
+
+		for _, staleKeptVM := range staleKeptVMs {
+			result = append(result, staleKeptVM.Name)
+		}
+
+		return result
+	}
+
+	opts := gc.Options{MinAge: time.Hour, ReuseMaxJobs: 50}
+
+	staleKeptVMs, err := gc.StaleKeptVMs(ctx, backend, opts)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{expired.VMName, gone.VMName}, names(staleKeptVMs))
+
+	// Unused VMs are stale once they were not used for the minimum age
+	opts.MinAge = 0
+
+	staleKeptVMs, err = gc.StaleKeptVMs(ctx, backend, opts)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{recent.VMName, expired.VMName, gone.VMName, reuse.VMNamePrefix + "orphaned"},
+		names(staleKeptVMs))
+
+	// Deleting removes both the VM and the lease
+	for _, staleKeptVM := range staleKeptVMs {
+		if staleKeptVM.Lease == nil {
+			continue
+		}
+
+		deleted, err := staleKeptVM.Lease.Delete(ctx, backend)
+		require.NoError(t, err)
+		require.True(t, deleted)
+	}
+
+	_, ok := backend.VM(expired.VMName)
+	require.False(t, ok)
+
+	leases, err := reuse.List()
+	require.NoError(t, err)
+	require.Len(t, leases, 1)
+	require.Equal(t, leased.VMName, leases[0].VMName)
+
+	// The leased VM is not deleted even if it was found to be stale before
+	deleted, err := leased.Delete(ctx, backend)
+	require.NoError(t, err)
+	require.False(t, deleted)
+}
+
+func TestStaleJobs(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	require.NoError(t, gc.RecordJob("1", "7"))
+	require.NoError(t, gc.RecordJob("2", "7"))
+
+	staleJobs, err := gc.StaleJobs([]string{"2"}, gc.Options{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1"}, staleJobs)
+
+	require.NoError(t, gc.ForgetJob("1"))
+	require.NoError(t, gc.ForgetJob("1"))
+
+	staleJobs, err = gc.StaleJobs(nil, gc.Options{MinAge: time.Hour})
+	require.NoError(t, err)
+	require.Empty(t, staleJobs)
+}
+
+func TestStaleHostDirs(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	for _, path := range []string{
+		filepath.Join(tmpDir, "tart-executor-host-dir-1"),
+		filepath.Join(tmpDir, "runner-job-2.tmp", "tart-executor-host-dir-2"),
+		filepath.Join(tmpDir, "tart-executor-host-dir-3"),
+	} {
+		require.NoError(t, os.MkdirAll(path, 0700))
+	}
+
+	staleHostDirs, err := gc.StaleHostDirs([]string{tmpDir}, []string{"3"}, gc.Options{})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		filepath.Join(tmpDir, "tart-executor-host-dir-1"),
+		filepath.Join(tmpDir, "runner-job-2.tmp", "tart-executor-host-dir-2"),
+	}, staleHostDirs)
+}
@@ -10,11 +10,23 @@ import (
 
 var ErrGitLabEnv = errors.New("GitLab environment error")
 
+const (
+	VirtualMachineIDPrefix = "gitlab-"
+	HostDirPrefix          = "tart-executor-host-dir-"
+)
+
 type Env struct {
 	JobID           string
 	JobImage        string
+	ProjectID       string
+	ProjectPath     string
+	JobToken        string //nolint:gosec // G117 is a false-positive here: we don't serialize this structure (e.g. JSON)
 	FailureExitCode int
 	Registry        *Registry
+
+	// ProjectVerified is set by VerifyProject(), otherwise
+	// the project can't be trusted since the job sets it
+	ProjectVerified bool
 }
 
 type Registry struct {
@@ -24,11 +36,11 @@ type Registry struct {
 }
 
 func (e Env) VirtualMachineID() string {
-	return fmt.Sprintf("gitlab-%s", e.JobID)
+	return VirtualMachineIDPrefix + e.JobID
 }
 
 func (e Env) HostDirPath() string {
-	return filepath.Join(os.TempDir(), fmt.Sprintf("tart-executor-host-dir-%s", e.JobID))
+	return filepath.Join(os.TempDir(), HostDirPrefix+e.JobID)
 }
 
 func InitEnv() (*Env, error) {
@@ -40,6 +52,9 @@ func InitEnv() (*Env, error) {
 
 	result.JobID = jobID
 	result.JobImage = os.Getenv("CUSTOM_ENV_CI_JOB_IMAGE")
+	result.ProjectID = os.Getenv("CUSTOM_ENV_CI_PROJECT_ID")
+	result.ProjectPath = os.Getenv("CUSTOM_ENV_CI_PROJECT_PATH")
+	result.JobToken = os.Getenv("CUSTOM_ENV_CI_JOB_TOKEN")
 
 	failureExitCodeRaw := os.Getenv("BUILD_FAILURE_EXIT_CODE")
 	if failureExitCodeRaw == "" {
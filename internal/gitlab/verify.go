@@ -0,0 +1,88 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var ErrProjectVerification = errors.New("failed to verify the job's project")
+
+// VerifyProject checks the job's project path, which the job can override using
+// the CI_PROJECT_PATH variable, against the one that the GitLab instance at serverURL
+// reports for the job's CI_JOB_TOKEN, and takes the project ID from there too.
+//
+// The serverURL needs to come from the operator, since the job can override
+// CI_SERVER_URL too and point it to a server that reports anything it wants.
+func (e *Env) VerifyProject(ctx context.Context, serverURL string) error {
+	if e.JobToken == "" {
+		return fmt.Errorf("%w: CUSTOM_ENV_CI_JOB_TOKEN is missing", ErrProjectVerification)
+	}
+
+	server, err := url.Parse(strings.TrimSuffix(serverURL, "/"))
+	if err != nil {
+		return fmt.Errorf("%w: invalid GitLab URL: %v", ErrProjectVerification, err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.String()+"/api/v4/job", nil)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("JOB-TOKEN", e.JobToken)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProjectVerification, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: got HTTP %d", ErrProjectVerification, response.StatusCode)
+	}
+
+	var job struct {
+		ID       int64  `json:"id"`
+		WebURL   string `json:"web_url"`
+		Pipeline struct {
+			ProjectID int64 `json:"project_id"`
+		} `json:"pipeline"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&job); err != nil {
+		return fmt.Errorf("%w: %v", ErrProjectVerification, err)
+	}
+
+	// A token of another job can't be used to impersonate its project
+	if strconv.FormatInt(job.ID, 10) != e.JobID {
+		return fmt.Errorf("%w: the job token belongs to job %d, not %s", ErrProjectVerification,
+			job.ID, e.JobID)
+	}
+
+	// The job's web URL is "<GitLab URL>/<project path>/-/jobs/<job ID>"
+	webURL, err := url.Parse(job.WebURL)
+	if err != nil {
+		return fmt.Errorf("%w: invalid job URL: %v", ErrProjectVerification, err)
+	}
+
+	projectPath, _, ok := strings.Cut(strings.TrimPrefix(webURL.Path, server.Path), "/-/jobs/")
+	projectPath = strings.Trim(projectPath, "/")
+	if !ok || projectPath == "" {
+		return fmt.Errorf("%w: unexpected job URL %q", ErrProjectVerification, job.WebURL)
+	}
+
+	if e.ProjectPath != projectPath {
+		return fmt.Errorf("%w: the job claims to belong to project %q, but it belongs to %q",
+			ErrProjectVerification, e.ProjectPath, projectPath)
+	}
+
+	e.ProjectID = strconv.FormatInt(job.Pipeline.ProjectID, 10)
+	e.ProjectVerified = true
+
+	return nil
+}
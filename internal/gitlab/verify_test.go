@@ -0,0 +1,60 @@
+package gitlab_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/gitlab"
+	"github.com/stretchr/testify/require"
+)
+
+func newServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	var server *httptest.Server
+
+	server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/gitlab/api/v4/job" || request.Header.Get("JOB-TOKEN") != "token-42" {
+			writer.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		_, _ = fmt.Fprintf(writer, `{"id": 42, "web_url": "%s/gitlab/infra/tools/-/jobs/42", `+
+			`"pipeline": {"project_id": 7}}`, server.URL)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestVerifyProject(t *testing.T) {
+	server := newServer(t)
+
+	env := &gitlab.Env{JobID: "42", JobToken: "token-42", ProjectPath: "infra/tools", ProjectID: "1"}
+	require.NoError(t, env.VerifyProject(context.Background(), server.URL+"/gitlab/"))
+	require.True(t, env.ProjectVerified)
+	require.Equal(t, "7", env.ProjectID)
+}
+
+func TestVerifyProjectOverridden(t *testing.T) {
+	server := newServer(t)
+
+	for _, env := range []*gitlab.Env{
+		// The job overrides CI_PROJECT_PATH
+		{JobID: "42", JobToken: "token-42", ProjectPath: "infra/secrets"},
+		// The job uses the token of another job
+		{JobID: "43", JobToken: "token-42", ProjectPath: "infra/tools"},
+		// The job uses an invalid token
+		{JobID: "42", JobToken: "token-43", ProjectPath: "infra/tools"},
+		// The job has no token at all
+		{JobID: "42", ProjectPath: "infra/tools"},
+	} {
+		err := env.VerifyProject(context.Background(), server.URL+"/gitlab")
+		require.ErrorIs(t, err, gitlab.ErrProjectVerification)
+		require.False(t, env.ProjectVerified)
+	}
+}
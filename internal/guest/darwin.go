@@ -0,0 +1,40 @@
+package guest
+
+import (
+	_ "embed"
+	"fmt"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/shell"
+)
+
+//go:embed grow-partition-darwin.sh
+var growPartitionDarwinScript string
+
+type darwin struct{}
+
+func (darwin) SetTimezoneCommand(timezone string) string {
+	return fmt.Sprintf("sudo systemsetup settimezone %s", shell.Quote(timezone))
+}
+
+func (darwin) MountScript(tag string, path string) string {
+	return fmt.Sprintf("mkdir -p %s\nmount_virtiofs %s %s\n", shell.Quote(path), shell.Quote(tag), shell.Quote(path))
+}
+
+func (darwin) InstallGitlabRunnerScript(installGitlabRunner string) (string, error) {
+	return installGitlabRunnerScript(installGitlabRunner, func(installGitlabRunner string) string {
+		switch installGitlabRunner {
+		case "brew":
+			return installGitlabRunnerBrewScript
+		case "true", "yes", "on":
+			warnDeprecatedInstallGitlabRunner(installGitlabRunner)
+
+			return installGitlabRunnerAutoScript
+		default:
+			return ""
+		}
+	})
+}
+
+func (darwin) GrowPartitionScript() string {
+	return growPartitionDarwinScript
+}
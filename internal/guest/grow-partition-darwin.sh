@@ -0,0 +1,13 @@
+#!/bin/bash
+
+set -euo pipefail
+
+echo "Growing the APFS container to fill the disk..."
+
+# Repairing the disk moves the recovery partition out of the way, if needed.
+# The confirmation is answered with a here-string rather than "yes |", which
+# would be killed by SIGPIPE and thus fail the whole script due to pipefail.
+sudo diskutil repairDisk disk0 <<< y
+
+# Zero size means "as large as possible"
+sudo diskutil apfs resizeContainer disk0s2 0
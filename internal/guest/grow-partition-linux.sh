@@ -0,0 +1,30 @@
+#!/bin/bash
+
+set -euo pipefail
+
+ROOT_PARTITION=$(findmnt -n -o SOURCE /)
+ROOT_DISK=/dev/$(lsblk -n -o PKNAME "$ROOT_PARTITION")
+ROOT_PARTITION_NUMBER=$(cat "/sys/class/block/$(basename "$ROOT_PARTITION")/partition")
+
+echo "Growing $ROOT_PARTITION to fill $ROOT_DISK..."
+
+# growpart exits with 1 when the partition can't be grown any further,
+# any other non-zero exit code (e.g. 127 when it's missing) is an error
+GROWPART_EXIT_CODE=0
+sudo growpart "$ROOT_DISK" "$ROOT_PARTITION_NUMBER" || GROWPART_EXIT_CODE=$?
+if [ "$GROWPART_EXIT_CODE" -ne 0 ] && [ "$GROWPART_EXIT_CODE" -ne 1 ]; then
+  echo "growpart failed with exit code $GROWPART_EXIT_CODE"
+  exit "$GROWPART_EXIT_CODE"
+fi
+
+case $(findmnt -n -o FSTYPE /) in
+  ext4)
+    sudo resize2fs "$ROOT_PARTITION"
+    ;;
+  xfs)
+    sudo xfs_growfs /
+    ;;
+  *)
+    echo "Don't know how to grow the $(findmnt -n -o FSTYPE /) filesystem, skipping"
+    ;;
+esac
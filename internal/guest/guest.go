@@ -0,0 +1,88 @@
+package guest
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+var (
+	ErrUnsupportedOS              = errors.New("unsupported guest OS")
+	ErrInvalidInstallGitlabRunner = errors.New("invalid TART_EXECUTOR_INSTALL_GITLAB_RUNNER value")
+)
+
+//go:embed install-gitlab-runner-auto.sh
+var installGitlabRunnerAutoScript string
+
+//go:embed install-gitlab-runner-brew.sh
+var installGitlabRunnerBrewScript string
+
+//go:embed install-gitlab-runner-curl.sh
+var installGitlabRunnerCurlScript string
+
+// Driver encapsulates the differences between the guest
+// operating systems when preparing the VM for the job.
+type Driver interface {
+	// SetTimezoneCommand returns a command that sets
+	// the guest's timezone (e.g. "Europe/Berlin").
+	SetTimezoneCommand(timezone string) string
+
+	// MountScript returns a script that mounts the
+	// directory shared with the given tag via "tart run --dir".
+	MountScript(tag string, path string) string
+
+	// InstallGitlabRunnerScript returns a script that installs the GitLab Runner
+	// according to the TART_EXECUTOR_INSTALL_GITLAB_RUNNER value, if any.
+	InstallGitlabRunnerScript(installGitlabRunner string) (string, error)
+
+	// GrowPartitionScript returns a script that grows
+	// the guest's root partition to fill the disk.
+	GrowPartitionScript() string
+}
+
+// NewDriver returns the driver for the OS reported by "tart get".
+func NewDriver(os string) (Driver, error) {
+	switch os {
+	case "darwin":
+		return darwin{}, nil
+	case "linux":
+		return linux{}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedOS, os)
+	}
+}
+
+// installGitlabRunnerScript handles the TART_EXECUTOR_INSTALL_GITLAB_RUNNER
+// values common to all OSes, while the OS-specific ones are handled by the
+// fallback, which returns an empty string when it doesn't support the value.
+func installGitlabRunnerScript(installGitlabRunner string, fallback func(string) string) (string, error) {
+	if script := fallback(installGitlabRunner); script != "" {
+		return script, nil
+	}
+
+	switch installGitlabRunner {
+	case "curl":
+		return installGitlabRunnerCurlScript, nil
+	case "":
+		return "", nil
+	default:
+		version, err := semver.NewVersion(installGitlabRunner)
+		if err == nil {
+			return strings.ReplaceAll(installGitlabRunnerCurlScript, "${GITLAB_RUNNER_VERSION}",
+				"v"+version.String()), nil
+		}
+
+		return "", fmt.Errorf("%w: only \"brew\" (macOS only), \"curl\" or \"major.minor.patch\" "+
+			"are supported, got %q", ErrInvalidInstallGitlabRunner, installGitlabRunner)
+	}
+}
+
+func warnDeprecatedInstallGitlabRunner(installGitlabRunner string) {
+	log.Printf("%q value for TART_EXECUTOR_INSTALL_GITLAB_RUNNER will deprecated "+
+		"in next version, please use either \"brew\", \"curl\" or \"major.minor.patch\"",
+		installGitlabRunner)
+}
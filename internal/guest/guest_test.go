@@ -0,0 +1,77 @@
+package guest_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/guest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDarwin(t *testing.T) {
+	driver, err := guest.NewDriver("darwin")
+	require.NoError(t, err)
+
+	require.Equal(t, "sudo systemsetup settimezone 'Europe/Berlin'", driver.SetTimezoneCommand("Europe/Berlin"))
+	require.Equal(t, "mkdir -p '/Users/admin/builds'\nmount_virtiofs 'tart.virtiofs.buildsdir.42' "+
+		"'/Users/admin/builds'\n", driver.MountScript("tart.virtiofs.buildsdir.42", "/Users/admin/builds"))
+
+	script, err := driver.InstallGitlabRunnerScript("brew")
+	require.NoError(t, err)
+	require.Contains(t, script, "brew install gitlab-runner")
+}
+
+func TestDarwinGrowPartitionScript(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not available")
+	}
+
+	driver, err := guest.NewDriver("darwin")
+	require.NoError(t, err)
+
+	// Stub the commands used by the script, with "diskutil" only
+	// reading the confirmation like the real one does and exiting
+	binDir := t.TempDir()
+	logPath := filepath.Join(t.TempDir(), "diskutil.log")
+
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "sudo"), []byte("#!/bin/bash\nexec \"$@\"\n"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "diskutil"), []byte("#!/bin/bash\n"+
+		"if [ \"$1\" = repairDisk ]; then read -r answer; echo \"$* $answer\" >> \"$LOG_PATH\"; "+
+		"else echo \"$*\" >> \"$LOG_PATH\"; fi\n"), 0700))
+
+	cmd := exec.Command(bash, "-c", driver.GrowPartitionScript())
+	cmd.Env = append(os.Environ(), "PATH="+binDir+":"+os.Getenv("PATH"), "LOG_PATH="+logPath)
+
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	log, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	require.Equal(t, "repairDisk disk0 y\napfs resizeContainer disk0s2 0\n", string(log))
+}
+
+func TestLinux(t *testing.T) {
+	driver, err := guest.NewDriver("linux")
+	require.NoError(t, err)
+
+	require.Equal(t, "sudo timedatectl set-timezone 'Europe/Berlin'", driver.SetTimezoneCommand("Europe/Berlin"))
+	require.Equal(t, "sudo mkdir -p '/builds'\nsudo mount -t virtiofs 'tart.virtiofs.buildsdir.42' '/builds'\n",
+		driver.MountScript("tart.virtiofs.buildsdir.42", "/builds"))
+
+	// There's no Homebrew on Linux
+	_, err = driver.InstallGitlabRunnerScript("brew")
+	require.ErrorIs(t, err, guest.ErrInvalidInstallGitlabRunner)
+
+	script, err := driver.InstallGitlabRunnerScript("16.0.0")
+	require.NoError(t, err)
+	require.Contains(t, script, `GITLAB_RUNNER_VERSION="latest"`)
+	require.Contains(t, script, "/v16.0.0/binaries/")
+}
+
+func TestUnsupportedOS(t *testing.T) {
+	_, err := guest.NewDriver("windows")
+	require.ErrorIs(t, err, guest.ErrUnsupportedOS)
+}
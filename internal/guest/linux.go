@@ -0,0 +1,43 @@
+package guest
+
+import (
+	_ "embed"
+	"fmt"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/shell"
+)
+
+//go:embed grow-partition-linux.sh
+var growPartitionLinuxScript string
+
+type linux struct{}
+
+func (linux) SetTimezoneCommand(timezone string) string {
+	return fmt.Sprintf("sudo timedatectl set-timezone %s", shell.Quote(timezone))
+}
+
+func (linux) MountScript(tag string, path string) string {
+	// Unlike on macOS, the mount points like /builds are
+	// outside the user's reach, so create them as root
+	return fmt.Sprintf("sudo mkdir -p %s\nsudo mount -t virtiofs %s %s\n", shell.Quote(path),
+		shell.Quote(tag), shell.Quote(path))
+}
+
+func (linux) InstallGitlabRunnerScript(installGitlabRunner string) (string, error) {
+	return installGitlabRunnerScript(installGitlabRunner, func(installGitlabRunner string) string {
+		switch installGitlabRunner {
+		case "true", "yes", "on":
+			warnDeprecatedInstallGitlabRunner(installGitlabRunner)
+
+			// There's usually no Homebrew on Linux, so the cURL
+			// script installs the Linux binary of the GitLab Runner
+			return installGitlabRunnerCurlScript
+		default:
+			return ""
+		}
+	})
+}
+
+func (linux) GrowPartitionScript() string {
+	return growPartitionLinuxScript
+}
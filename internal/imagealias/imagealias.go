@@ -0,0 +1,42 @@
+package imagealias
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// EnvResolvedImage is an internal environment variable that is set by
+// the "config" stage for the subsequent stages when the job's image is
+// an alias, and is exported to the job's script by the "run" stage.
+const EnvResolvedImage = "TART_EXECUTOR_RESOLVED_IMAGE"
+
+var ErrInvalidAlias = errors.New("invalid image alias")
+
+var aliases []string
+
+func IntroduceFlag(command *cobra.Command) {
+	command.PersistentFlags().StringArrayVar(&aliases, "image-alias", []string{},
+		"NAME=REFERENCE alias that allows the jobs to use a short name instead of the full image "+
+			"reference, can be specified multiple times "+
+			"(e.g. --image-alias sonoma-xcode-16=ghcr.io/cirruslabs/macos-sonoma-xcode:16.0)")
+}
+
+// Resolve returns the full image reference for the alias, or the
+// image itself along with false if it's not an alias.
+func Resolve(image string) (string, bool, error) {
+	for _, alias := range aliases {
+		name, reference, ok := strings.Cut(alias, "=")
+		if !ok || name == "" || reference == "" {
+			return "", false, fmt.Errorf("%w: expected NAME=REFERENCE, got %q", ErrInvalidAlias, alias)
+		}
+
+		if name == image {
+			return reference, true, nil
+		}
+	}
+
+	return image, false, nil
+}
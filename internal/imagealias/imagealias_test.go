@@ -0,0 +1,33 @@
+package imagealias_test
+
+import (
+	"testing"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/imagealias"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	command := &cobra.Command{}
+	imagealias.IntroduceFlag(command)
+	require.NoError(t, command.ParseFlags([]string{
+		"--image-alias", "sonoma-xcode-16=ghcr.io/cirruslabs/macos-sonoma-xcode:16.0",
+		"--image-alias", "sequoia-base=ghcr.io/cirruslabs/macos-sequoia-base:latest",
+	}))
+
+	image, ok, err := imagealias.Resolve("sonoma-xcode-16")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "ghcr.io/cirruslabs/macos-sonoma-xcode:16.0", image)
+
+	image, ok, err = imagealias.Resolve("ghcr.io/cirruslabs/macos-sonoma-base:latest")
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, "ghcr.io/cirruslabs/macos-sonoma-base:latest", image)
+
+	require.NoError(t, command.ParseFlags([]string{"--image-alias", "broken"}))
+
+	_, _, err = imagealias.Resolve("ghcr.io/cirruslabs/macos-sonoma-base:latest")
+	require.ErrorIs(t, err, imagealias.ErrInvalidAlias)
+}
@@ -0,0 +1,108 @@
+package imagepolicy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+var (
+	ErrNotAllowed  = errors.New("image is not allowed")
+	ErrInvalidRule = errors.New("invalid image rule")
+)
+
+// Rules decide which images the jobs may run, see the
+// --allow-image, --deny-image and --restrict-image
+// command-line arguments of the "prepare" stage.
+type Rules struct {
+	// Allow lists the patterns of the only images
+	// that are allowed, if non-empty
+	Allow []string
+
+	// Deny lists the patterns of the images that are
+	// denied, even if they are allowed otherwise
+	Deny []string
+
+	// Restrict lists the IMAGE_PATTERN=PROJECT_PATTERN rules that
+	// only allow the matching images in the matching projects
+	Restrict []string
+}
+
+// Check returns an error wrapping ErrNotAllowed if the project
+// with the given path (e.g. "group/subgroup/project") may not
+// run the image.
+func (rules Rules) Check(image string, projectPath string) error {
+	if len(rules.Allow) != 0 {
+		allowed, err := matchAny(rules.Allow, image)
+		if err != nil {
+			return err
+		}
+
+		if !allowed {
+			return fmt.Errorf("%w: %q is disallowed by GitLab Runner configuration", ErrNotAllowed, image)
+		}
+	}
+
+	// An image restricted by multiple rules is allowed
+	// for the projects matching any of these rules
+	var restricted, allowedForProject bool
+
+	for _, restrictRule := range rules.Restrict {
+		imagePattern, projectPattern, ok := strings.Cut(restrictRule, "=")
+		if !ok {
+			return fmt.Errorf("%w: --restrict-image expects IMAGE_PATTERN=PROJECT_PATTERN, got %q",
+				ErrInvalidRule, restrictRule)
+		}
+
+		match, err := doublestar.Match(imagePattern, image)
+		if err != nil {
+			return err
+		}
+		if !match {
+			continue
+		}
+
+		restricted = true
+
+		match, err = doublestar.Match(projectPattern, projectPath)
+		if err != nil {
+			return err
+		}
+		if match {
+			allowedForProject = true
+		}
+	}
+
+	if restricted && !allowedForProject {
+		return fmt.Errorf("%w: %q is disallowed for project %q by GitLab Runner configuration",
+			ErrNotAllowed, image, projectPath)
+	}
+
+	denied, err := matchAny(rules.Deny, image)
+	if err != nil {
+		return err
+	}
+
+	if denied {
+		return fmt.Errorf("%w: %q is denied by GitLab Runner configuration", ErrNotAllowed, image)
+	}
+
+	return nil
+}
+
+func matchAny(patterns []string, s string) (bool, error) {
+	for _, pattern := range patterns {
+		match, err := doublestar.Match(pattern, s)
+		if err != nil {
+			return false, err
+		}
+
+		if match {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
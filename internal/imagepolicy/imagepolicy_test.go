@@ -0,0 +1,55 @@
+package imagepolicy_test
+
+import (
+	"testing"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/imagepolicy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	rules := imagepolicy.Rules{
+		Allow:    []string{"ghcr.io/cirruslabs/**"},
+		Deny:     []string{"ghcr.io/cirruslabs/*-monterey-*"},
+		Restrict: []string{"**/*-xcode-beta*=infra/**", "**/*-xcode-beta*=mobile/ios"},
+	}
+
+	for _, testCase := range []struct {
+		image       string
+		projectPath string
+		allowed     bool
+	}{
+		// Only the images matching --allow-image can run
+		{"ghcr.io/cirruslabs/macos-sonoma-base:latest", "web/app", true},
+		{"docker.io/library/macos:latest", "web/app", false},
+
+		// Restricted images only run in the projects matching any of the rules
+		{"ghcr.io/cirruslabs/macos-sonoma-xcode-beta:16", "infra/tools", true},
+		{"ghcr.io/cirruslabs/macos-sonoma-xcode-beta:16", "mobile/ios", true},
+		{"ghcr.io/cirruslabs/macos-sonoma-xcode-beta:16", "web/app", false},
+
+		// --restrict-image doesn't allow images disallowed by --allow-image
+		{"docker.io/library/macos-xcode-beta:16", "infra/tools", false},
+
+		// --deny-image takes precedence over both --allow-image and --restrict-image
+		{"ghcr.io/cirruslabs/macos-monterey-base:latest", "web/app", false},
+		{"ghcr.io/cirruslabs/macos-monterey-xcode-beta:14", "infra/tools", false},
+	} {
+		err := rules.Check(testCase.image, testCase.projectPath)
+
+		if testCase.allowed {
+			require.NoError(t, err, "%s in %s", testCase.image, testCase.projectPath)
+		} else {
+			require.ErrorIs(t, err, imagepolicy.ErrNotAllowed, "%s in %s", testCase.image, testCase.projectPath)
+		}
+	}
+}
+
+func TestCheckNoRules(t *testing.T) {
+	require.NoError(t, imagepolicy.Rules{}.Check("docker.io/library/macos:latest", ""))
+}
+
+func TestCheckInvalidRule(t *testing.T) {
+	err := imagepolicy.Rules{Restrict: []string{"**/*-xcode-beta*"}}.Check("ghcr.io/cirruslabs/macos:latest", "")
+	require.ErrorIs(t, err, imagepolicy.ErrInvalidRule)
+}
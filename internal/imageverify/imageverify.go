@@ -0,0 +1,108 @@
+package imageverify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+)
+
+var ErrVerificationFailed = errors.New("image verification failed")
+
+const cosignCommandName = "cosign"
+
+type Options struct {
+	// RequireDigest only allows the digest-pinned
+	// image references (e.g. "image@sha256:...")
+	RequireDigest bool
+
+	// AllowedDigests, if not empty, is the list of
+	// image digests (e.g. "sha256:...") that are allowed
+	AllowedDigests []string
+
+	// PublicKeyPath, if not empty, is the path to a public key
+	// to verify the image's cosign signature against
+	PublicKeyPath string
+}
+
+// Enabled returns true when the image needs to be resolved to a digest.
+func (opts Options) Enabled() bool {
+	return len(opts.AllowedDigests) != 0 || opts.PublicKeyPath != ""
+}
+
+// Verify checks the image against the options and returns the
+// digest-pinned reference that should be used instead of the image,
+// so that the VM is cloned from exactly the image that was verified.
+func Verify(
+	ctx context.Context,
+	backend tart.Backend,
+	image string,
+	env map[string]string,
+	pullPolicy tart.PullPolicy,
+	pullOpts tart.PullOptions,
+	opts Options,
+) (string, error) {
+	if opts.RequireDigest && !strings.Contains(image, "@") {
+		return "", fmt.Errorf("%w: image %q is not pinned to a digest", ErrVerificationFailed, image)
+	}
+
+	if !opts.Enabled() {
+		return image, nil
+	}
+
+	log.Printf("Resolving %s to a digest...\n", image)
+
+	if err := tart.PullIfNeeded(ctx, backend, env, image, pullPolicy, pullOpts); err != nil {
+		return "", err
+	}
+
+	pinnedImage, err := backend.FQN(ctx, image)
+	if err != nil {
+		return "", err
+	}
+
+	_, digest, ok := strings.Cut(pinnedImage, "@")
+	if !ok {
+		return "", fmt.Errorf("%w: failed to resolve image %q to a digest, got %q",
+			ErrVerificationFailed, image, pinnedImage)
+	}
+
+	if len(opts.AllowedDigests) != 0 && !slices.Contains(opts.AllowedDigests, digest) {
+		return "", fmt.Errorf("%w: digest %s of image %q is not in the allow-list",
+			ErrVerificationFailed, digest, image)
+	}
+
+	if opts.PublicKeyPath != "" {
+		if err := verifySignature(ctx, pinnedImage, opts.PublicKeyPath); err != nil {
+			return "", err
+		}
+	}
+
+	log.Printf("Verified %s\n", pinnedImage)
+
+	return pinnedImage, nil
+}
+
+func verifySignature(ctx context.Context, pinnedImage string, publicKeyPath string) error {
+	cosignCommandPath, err := exec.LookPath(cosignCommandName)
+	if err != nil {
+		return fmt.Errorf("%w: %q command is required to verify the image signature: %v",
+			ErrVerificationFailed, cosignCommandName, err)
+	}
+
+	//nolint:gosec // it's OK to launch a subrocess with variable
+	cmd := exec.CommandContext(ctx, cosignCommandPath, "verify", "--key", publicKeyPath, pinnedImage)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: signature of image %q doesn't match the public key %s: %v: %s",
+			ErrVerificationFailed, pinnedImage, publicKeyPath, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package imageverify_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/imageverify"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+	pullPolicy := tart.PullPolicy{Mode: tart.PullPolicyAlways}
+
+	const (
+		image  = "ghcr.io/cirruslabs/macos-sonoma-base:latest"
+		digest = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	)
+
+	backend.Digests[image] = digest
+
+	// Nothing to verify
+	verifiedImage, err := imageverify.Verify(ctx, backend, image, nil, pullPolicy, tart.PullOptions{},
+		imageverify.Options{})
+	require.NoError(t, err)
+	require.Equal(t, image, verifiedImage)
+
+	_, err = imageverify.Verify(ctx, backend, image, nil, pullPolicy, tart.PullOptions{},
+		imageverify.Options{RequireDigest: true})
+	require.ErrorIs(t, err, imageverify.ErrVerificationFailed)
+
+	// Tags are resolved to the digest-pinned references
+	verifiedImage, err = imageverify.Verify(ctx, backend, image, nil, pullPolicy, tart.PullOptions{},
+		imageverify.Options{AllowedDigests: []string{digest}})
+	require.NoError(t, err)
+	require.Equal(t, "ghcr.io/cirruslabs/macos-sonoma-base@"+digest, verifiedImage)
+
+	// Re-pointed tags are rejected
+	backend.Digests[image] = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+	_, err = imageverify.Verify(ctx, backend, image, nil, pullPolicy, tart.PullOptions{},
+		imageverify.Options{AllowedDigests: []string{digest}})
+	require.ErrorIs(t, err, imageverify.ErrVerificationFailed)
+}
@@ -0,0 +1,387 @@
+package metrics
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/eventlog"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/filelock"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+	"github.com/spf13/cobra"
+)
+
+const EnvMetricsFile = "TART_EXECUTOR_METRICS_FILE"
+
+const (
+	metricStageDuration = "tart_executor_stage_duration_seconds"
+	metricStages        = "tart_executor_stages_total"
+	metricStepDuration  = "tart_executor_step_duration_seconds"
+	metricStepFailures  = "tart_executor_step_failures_total"
+	metricTimeToSSH     = "tart_executor_time_to_ssh_seconds"
+	metricScriptExits   = "tart_executor_script_exit_codes_total"
+)
+
+var help = map[string]string{
+	metricStageDuration: "Duration of the GitLab Runner stages.",
+	metricStages:        "Number of finished GitLab Runner stages by status.",
+	metricStepDuration:  "Duration of the successful steps of the GitLab Runner stages.",
+	metricStepFailures:  "Number of failed steps of the GitLab Runner stages.",
+	metricTimeToSSH:     "Time from starting the VM to it being reachable over SSH.",
+	metricScriptExits:   "Number of job scripts by exit code.",
+}
+
+// durationBuckets covers everything from a sub-second "tart set"
+// to a cold pull of a multi-gigabyte image.
+var durationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// otherImage is the image label value for the images not matching
+// any of the --metrics-image patterns, which keeps the cardinality
+// bounded regardless of the images used by the jobs.
+const otherImage = "other"
+
+const (
+	// Series that were not updated for this long are dropped,
+	// e.g. when the image pattern is no longer configured
+	seriesTTL = 7 * 24 * time.Hour
+
+	// The maximum number of series kept, the least
+	// recently updated series are dropped first
+	maxSeries = 1000
+)
+
+var path string
+
+var imagePatterns []string
+
+var (
+	mtx         sync.Mutex
+	pending     = map[string]*Series{}
+	vmStartedAt time.Time
+)
+
+// Series is a single counter or histogram with a given set of labels.
+type Series struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+
+	// Counter's value or histogram's sum
+	Value float64 `json:"value"`
+
+	// Histogram only, non-cumulative
+	Buckets []uint64 `json:"buckets,omitempty"`
+	Count   uint64   `json:"count,omitempty"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func IntroduceFlag(command *cobra.Command) {
+	command.PersistentFlags().StringVar(&path, "metrics-file", os.Getenv(EnvMetricsFile),
+		"path to a Prometheus metrics file to update at the end of each stage, e.g. for the "+
+			"node_exporter's textfile collector (can also be set via the "+EnvMetricsFile+
+			" environment variable)")
+	command.PersistentFlags().StringArrayVar(&imagePatterns, "metrics-image", []string{},
+		"doublestar-compatible pattern to label the metrics of the matching images with (e.g. the "+
+			"same patterns as for --allow-image), the rest are labeled as \""+otherImage+"\", "+
+			"can be specified multiple times")
+}
+
+// Observe records the metrics derived from the event log events,
+// see eventlog.Subscribe.
+func Observe(event eventlog.Event) {
+	if path == "" {
+		return
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	labels := map[string]string{
+		"stage": event.Stage,
+		"image": imageLabel(event.Image),
+	}
+
+	switch {
+	case event.Event == "stage":
+		observeHistogram(metricStageDuration, labels, event.DurationSeconds)
+		inc(metricStages, withLabel(labels, "status", event.Status))
+	case event.Status == eventlog.StatusStarted:
+		if event.Event == "start" {
+			vmStartedAt = event.Time
+		}
+	case event.Status == eventlog.StatusSucceeded:
+		observeHistogram(metricStepDuration, withLabel(labels, "step", event.Event), event.DurationSeconds)
+
+		if event.Event == "ssh" && !vmStartedAt.IsZero() {
+			observeHistogram(metricTimeToSSH, labels, event.Time.Sub(vmStartedAt).Seconds())
+		}
+	case event.Status == eventlog.StatusFailed:
+		inc(metricStepFailures, withLabel(labels, "step", event.Event))
+	}
+
+	if event.ExitCode != nil {
+		inc(metricScriptExits, withLabel(labels, "exit_code", strconv.Itoa(*event.ExitCode)))
+	}
+}
+
+// Flush merges the metrics recorded by this stage into the metrics file.
+//
+// Failing to update the metrics is not fatal to the job,
+// so the errors are only logged.
+func Flush() {
+	if path == "" {
+		return
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if err := flush(); err != nil {
+		log.Printf("Failed to update the metrics file: %v\n", err)
+	}
+
+	pending = map[string]*Series{}
+}
+
+func flush() error {
+	statePath, err := statedir.Path("metrics.json")
+	if err != nil {
+		return err
+	}
+
+	lock, err := filelock.Lock(statePath + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	state := map[string]*Series{}
+
+	stateBytes, err := os.ReadFile(statePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(stateBytes, &state); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+
+	for key, series := range pending {
+		existing, ok := state[key]
+		if !ok {
+			series.UpdatedAt = now
+			state[key] = series
+
+			continue
+		}
+
+		existing.Value += series.Value
+		existing.Count += series.Count
+		existing.UpdatedAt = now
+
+		for i := range series.Buckets {
+			if i < len(existing.Buckets) {
+				existing.Buckets[i] += series.Buckets[i]
+			}
+		}
+	}
+
+	prune(state, now)
+
+	stateBytes, err = json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(statePath, stateBytes, 0600); err != nil {
+		return err
+	}
+
+	// Write the metrics file atomically, otherwise the
+	// textfile collector might read a partially written file
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	//nolint:gosec // G306 shouldn't apply here as the metrics are meant to be read by other tools
+	if err := os.WriteFile(tmpPath, []byte(render(state)), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// prune drops the series that were not updated for seriesTTL
+// and the least recently updated ones beyond maxSeries.
+func prune(state map[string]*Series, now time.Time) {
+	keys := make([]string, 0, len(state))
+
+	for key, series := range state {
+		if now.Sub(series.UpdatedAt) >= seriesTTL {
+			delete(state, key)
+
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) <= maxSeries {
+		return
+	}
+
+	slices.SortFunc(keys, func(a, b string) int {
+		return state[b].UpdatedAt.Compare(state[a].UpdatedAt)
+	})
+
+	for _, key := range keys[maxSeries:] {
+		delete(state, key)
+	}
+}
+
+// imageLabel returns the first --metrics-image pattern that matches the image.
+func imageLabel(image string) string {
+	for _, pattern := range imagePatterns {
+		if match, err := doublestar.Match(pattern, image); err == nil && match {
+			return pattern
+		}
+	}
+
+	return otherImage
+}
+
+func render(state map[string]*Series) string {
+	var result strings.Builder
+
+	keys := make([]string, 0, len(state))
+	for key := range state {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Or(cmp.Compare(state[a].Name, state[b].Name), cmp.Compare(a, b))
+	})
+
+	var lastName string
+
+	for _, key := range keys {
+		series := state[key]
+
+		if series.Name != lastName {
+			metricType := "counter"
+			if series.Buckets != nil {
+				metricType = "histogram"
+			}
+
+			fmt.Fprintf(&result, "# HELP %s %s\n", series.Name, help[series.Name])
+			fmt.Fprintf(&result, "# TYPE %s %s\n", series.Name, metricType)
+
+			lastName = series.Name
+		}
+
+		if series.Buckets == nil {
+			fmt.Fprintf(&result, "%s%s %s\n", series.Name, formatLabels(series.Labels), formatValue(series.Value))
+
+			continue
+		}
+
+		var cumulative uint64
+
+		for i, upperBound := range durationBuckets {
+			if i < len(series.Buckets) {
+				cumulative += series.Buckets[i]
+			}
+
+			fmt.Fprintf(&result, "%s_bucket%s %d\n", series.Name,
+				formatLabels(withLabel(series.Labels, "le", formatValue(upperBound))), cumulative)
+		}
+
+		fmt.Fprintf(&result, "%s_bucket%s %d\n", series.Name,
+			formatLabels(withLabel(series.Labels, "le", "+Inf")), series.Count)
+		fmt.Fprintf(&result, "%s_sum%s %s\n", series.Name, formatLabels(series.Labels), formatValue(series.Value))
+		fmt.Fprintf(&result, "%s_count%s %d\n", series.Name, formatLabels(series.Labels), series.Count)
+	}
+
+	return result.String()
+}
+
+func inc(name string, labels map[string]string) {
+	get(name, labels, false).Value++
+}
+
+func observeHistogram(name string, labels map[string]string, value float64) {
+	series := get(name, labels, true)
+
+	series.Value += value
+	series.Count++
+
+	for i, upperBound := range durationBuckets {
+		if value <= upperBound {
+			series.Buckets[i]++
+
+			break
+		}
+	}
+}
+
+func get(name string, labels map[string]string, histogram bool) *Series {
+	key := name + formatLabels(labels)
+
+	series, ok := pending[key]
+	if !ok {
+		series = &Series{
+			Name:   name,
+			Labels: labels,
+		}
+
+		if histogram {
+			series.Buckets = make([]uint64, len(durationBuckets))
+		}
+
+		pending[key] = series
+	}
+
+	return series
+}
+
+func withLabel(labels map[string]string, key string, value string) map[string]string {
+	result := make(map[string]string, len(labels)+1)
+
+	for k, v := range labels {
+		result[k] = v
+	}
+
+	result[key] = value
+
+	return result
+}
+
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var parts []string
+
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%s", key, strconv.Quote(labels[key])))
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
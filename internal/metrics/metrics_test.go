@@ -0,0 +1,101 @@
+package metrics_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/eventlog"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/metrics"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlush(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	path := filepath.Join(t.TempDir(), "tart_executor.prom")
+	t.Setenv(metrics.EnvMetricsFile, path)
+
+	command := &cobra.Command{}
+	metrics.IntroduceFlag(command)
+	require.NoError(t, command.ParseFlags([]string{"--metrics-image", "ghcr.io/cirruslabs/macos-sonoma-*"}))
+	eventlog.Subscribe(metrics.Observe)
+	eventlog.SetJob("1", "ghcr.io/cirruslabs/macos-sonoma-base:latest")
+
+	// Metrics from the subsequent stages are accumulated
+	for range 2 {
+		eventlog.SetStage("run")
+		eventlog.Begin("script", "gitlab-1").EndWithExitCode(1, errors.New("exited with 1"))
+		eventlog.Finish(nil)
+		metrics.Flush()
+	}
+
+	eventlog.SetStage("cleanup")
+	eventlog.Begin("delete", "gitlab-1").End(errors.New("VM errored"))
+	eventlog.Finish(errors.New("VM errored"))
+	metrics.Flush()
+
+	// Images not matching any of the patterns share the same label
+	eventlog.SetJob("2", "ghcr.io/attacker/image:1234")
+	eventlog.SetStage("run")
+	eventlog.Finish(nil)
+	metrics.Flush()
+
+	metricsBytes, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	const labels = `image="ghcr.io/cirruslabs/macos-sonoma-*",stage="run"`
+
+	require.Contains(t, string(metricsBytes), "# TYPE tart_executor_stage_duration_seconds histogram\n")
+	require.Contains(t, string(metricsBytes), "tart_executor_stage_duration_seconds_bucket{"+
+		`image="ghcr.io/cirruslabs/macos-sonoma-*",le="1",stage="run"} 2`+"\n")
+	require.Contains(t, string(metricsBytes), "tart_executor_stage_duration_seconds_count{"+labels+"} 2\n")
+	require.Contains(t, string(metricsBytes), `tart_executor_script_exit_codes_total{exit_code="1",`+
+		labels+"} 2\n")
+	require.Contains(t, string(metricsBytes), "tart_executor_stages_total{"+
+		`image="ghcr.io/cirruslabs/macos-sonoma-*",stage="cleanup",status="failed"} 1`+"\n")
+	require.Contains(t, string(metricsBytes), "tart_executor_step_failures_total{"+
+		`image="ghcr.io/cirruslabs/macos-sonoma-*",stage="cleanup",step="delete"} 1`+"\n")
+	require.Contains(t, string(metricsBytes), "tart_executor_stages_total{"+
+		`image="other",stage="run",status="succeeded"} 1`+"\n")
+	require.NotContains(t, string(metricsBytes), "attacker")
+}
+
+func TestFlushExpiresStaleSeries(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	path := filepath.Join(t.TempDir(), "tart_executor.prom")
+	t.Setenv(metrics.EnvMetricsFile, path)
+
+	metrics.IntroduceFlag(&cobra.Command{})
+	eventlog.Subscribe(metrics.Observe)
+	eventlog.SetJob("1", "ghcr.io/cirruslabs/macos-sonoma-base:latest")
+
+	statePath, err := statedir.Path("metrics.json")
+	require.NoError(t, err)
+
+	stateBytes, err := json.Marshal(map[string]*metrics.Series{
+		`tart_executor_stages_total{image="stale"}`: {
+			Name:      "tart_executor_stages_total",
+			Labels:    map[string]string{"image": "stale"},
+			Value:     1,
+			UpdatedAt: time.Now().Add(-30 * 24 * time.Hour),
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(statePath, stateBytes, 0600))
+
+	eventlog.SetStage("cleanup")
+	eventlog.Finish(nil)
+	metrics.Flush()
+
+	metricsBytes, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(metricsBytes), "tart_executor_stages_total{")
+	require.NotContains(t, string(metricsBytes), "stale")
+}
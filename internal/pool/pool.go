@@ -0,0 +1,312 @@
+package pool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/admission"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/filelock"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+)
+
+// VMNamePrefix is used for the warm pool VMs, which intentionally
+// differs from the "gitlab-" prefix used for the job VMs.
+const VMNamePrefix = "tart-executor-pool-"
+
+const (
+	entrySuffix     = ".json"
+	claimedSuffix   = ".claimed"
+	pidFileName     = "pool.pid"
+	pidLockAttempts = 10
+	pidLockDelay    = 100 * time.Millisecond
+)
+
+var ErrAlreadyRunning = errors.New("another warm pool daemon is already running")
+
+// Spec describes everything that affects how a warm pool VM
+// was cloned and started, so that "prepare" only claims the VMs
+// that are indistinguishable from the ones it would create itself.
+type Spec struct {
+	Image      string           `json:"image"`
+	CPU        uint64           `json:"cpu"`
+	Memory     uint64           `json:"memory"`
+	Settings   tart.RunSettings `json:"settings"`
+	Nested     bool             `json:"nested"`
+	Dirs       []string         `json:"dirs"`
+	Disks      []string         `json:"disks"`
+	TartRunEnv []string         `json:"tart_run_env"`
+}
+
+func (spec Spec) Equal(other Spec) bool {
+	return spec.Image == other.Image &&
+		spec.CPU == other.CPU &&
+		spec.Memory == other.Memory &&
+		spec.Settings == other.Settings &&
+		spec.Nested == other.Nested &&
+		slices.Equal(spec.Dirs, other.Dirs) &&
+		slices.Equal(spec.Disks, other.Disks) &&
+		slices.Equal(spec.TartRunEnv, other.TartRunEnv)
+}
+
+// Entry is a booted VM that is ready to be claimed.
+type Entry struct {
+	Name       string    `json:"name"`
+	Spec       Spec      `json:"spec"`
+	OutputPath string    `json:"output_path"`
+	PIDPath    string    `json:"pid_path,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	// PinnedImage is the digest-pinned reference (see tart.Backend.FQN)
+	// of the image the VM was cloned from, if known
+	PinnedImage string `json:"pinned_image,omitempty"`
+}
+
+// Matches returns true if the VM is indistinguishable from the one that would
+// be created for the spec, including the case when the spec's image is the
+// digest-pinned reference (e.g. after "prepare" has verified the image).
+func (entry Entry) Matches(spec Spec) bool {
+	if entry.Spec.Equal(spec) {
+		return true
+	}
+
+	if entry.PinnedImage == "" {
+		return false
+	}
+
+	pinnedSpec := entry.Spec
+	pinnedSpec.Image = entry.PinnedImage
+
+	return pinnedSpec.Equal(spec)
+}
+
+func Dir() (string, error) {
+	return statedir.Dir("pool")
+}
+
+// Add makes the VM available to be claimed.
+func Add(entry Entry) error {
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+
+	entryBytes, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first to avoid
+	// exposing a partially-written entry
+	tmpPath := filepath.Join(dir, entry.Name+".tmp")
+
+	if err := os.WriteFile(tmpPath, entryBytes, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(dir, entry.Name+entrySuffix))
+}
+
+// Entries returns the VMs that are ready to be claimed, oldest first.
+func Entries() ([]Entry, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+entrySuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+
+	for _, path := range paths {
+		entryBytes, err := os.ReadFile(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// Claimed in the meantime
+				continue
+			}
+
+			return nil, err
+		}
+
+		var entry Entry
+
+		if err := json.Unmarshal(entryBytes, &entry); err != nil {
+			log.Printf("Ignoring malformed warm pool entry %s: %v\n", path, err)
+
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	return entries, nil
+}
+
+// Take atomically removes the entry from the pool, only one caller
+// can succeed in taking a given entry.
+func Take(entry Entry) (bool, error) {
+	dir, err := Dir()
+	if err != nil {
+		return false, err
+	}
+
+	entryPath := filepath.Join(dir, entry.Name+entrySuffix)
+	claimedPath := entryPath + claimedSuffix
+
+	if err := os.Rename(entryPath, claimedPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// Somebody else was faster
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, os.Remove(claimedPath)
+}
+
+// Claim finds a VM matching the spec in the pool, takes it
+// and renames it to the specified name. Returns nil when
+// no matching VMs are available.
+//
+//nolint:nilnil // having no matching VMs in the pool is not an error
+func Claim(ctx context.Context, backend tart.Backend, spec Spec, name string) (*tart.VM, error) {
+	entries, err := Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.Matches(spec) {
+			continue
+		}
+
+		taken, err := Take(entry)
+		if err != nil {
+			return nil, err
+		}
+		if !taken {
+			continue
+		}
+
+		// The resources reserved by the warm pool daemon
+		// for the VM (see admission.Admit) now belong to the job
+		var vm *tart.VM
+
+		err = admission.Handover(ctx, backend, entry.Name, name, func() error {
+			vm, err = tart.AdoptVM(ctx, backend, entry.Name, entry.OutputPath, entry.PIDPath, name)
+
+			return err
+		})
+		if err != nil {
+			log.Printf("Failed to claim VM %s from the warm pool, discarding it: %v\n", entry.Name, err)
+
+			_ = backend.Stop(ctx, entry.Name)
+			_ = backend.Delete(ctx, entry.Name)
+
+			continue
+		}
+
+		return vm, nil
+	}
+
+	return nil, nil
+}
+
+// LockPIDFile records the current process as the warm pool daemon, so that
+// Notify() knows whom to signal. The returned lock needs to be held for as long
+// as the daemon runs: Notify() only signals the recorded process while the file
+// is locked, so a PID left by a crashed daemon and reused by an unrelated process
+// is never signalled.
+func LockPIDFile() (*filelock.FileLock, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+
+	pidPath := filepath.Join(dir, pidFileName)
+
+	for attempt := 1; ; attempt++ {
+		pidLock, err := filelock.TryLock(pidPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if pidLock != nil {
+			if err := os.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())), 0600); err != nil {
+				_ = pidLock.Unlock()
+
+				return nil, err
+			}
+
+			return pidLock, nil
+		}
+
+		// Notify() briefly holds the shared lock when checking
+		// whether the daemon is running, so retry a few times
+		if attempt == pidLockAttempts {
+			return nil, ErrAlreadyRunning
+		}
+
+		time.Sleep(pidLockDelay)
+	}
+}
+
+// Notify asks the warm pool daemon (if any) to replenish the pool.
+func Notify() error {
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+
+	pidPath := filepath.Join(dir, pidFileName)
+
+	// Being able to lock the PID file means that no warm pool daemon is running
+	pidLock, err := filelock.TryRLock(pidPath)
+	if err != nil {
+		return err
+	}
+	if pidLock != nil {
+		return pidLock.Unlock()
+	}
+
+	pidBytes, err := os.ReadFile(pidPath)
+	if err != nil {
+		return err
+	}
+
+	// The warm pool daemon is just starting and
+	// is going to replenish the pool anyway
+	if len(strings.TrimSpace(string(pidBytes))) == 0 {
+		return nil
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
+	if err != nil {
+		return fmt.Errorf("failed to parse warm pool daemon's PID: %w", err)
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGUSR1); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+
+	return nil
+}
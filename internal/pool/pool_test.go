@@ -0,0 +1,181 @@
+package pool_test
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/admission"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/pool"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaim(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+	t.Setenv("TMPDIR", t.TempDir())
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+
+	spec := pool.Spec{
+		Image: "ghcr.io/cirruslabs/macos-sonoma-base:latest",
+		CPU:   4,
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "output.log")
+
+	require.NoError(t, backend.Clone(ctx, nil, spec.Image, pool.VMNamePrefix+"test", tart.PullOptions{}))
+	require.NoError(t, backend.Run(ctx, pool.VMNamePrefix+"test", tart.RunOptions{OutputPath: outputPath}))
+	require.NoError(t, pool.Add(pool.Entry{
+		Name:       pool.VMNamePrefix + "test",
+		Spec:       spec,
+		OutputPath: outputPath,
+		CreatedAt:  time.Now(),
+	}))
+
+	// VMs with a different spec are not claimed
+	otherSpec := spec
+	otherSpec.CPU = 8
+
+	vm, err := pool.Claim(ctx, backend, otherSpec, "gitlab-1")
+	require.NoError(t, err)
+	require.Nil(t, vm)
+
+	// VMs with a matching spec are claimed and renamed
+	vm, err = pool.Claim(ctx, backend, spec, "gitlab-1")
+	require.NoError(t, err)
+	require.NotNil(t, vm)
+	require.Equal(t, "gitlab-1", vm.Name())
+
+	fakeVM, ok := backend.VM("gitlab-1")
+	require.True(t, ok)
+	require.True(t, fakeVM.Running)
+
+	// Each VM can only be claimed once
+	vm, err = pool.Claim(ctx, backend, spec, "gitlab-2")
+	require.NoError(t, err)
+	require.Nil(t, vm)
+}
+
+func TestClaimHandsOverReservation(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+	t.Setenv("TMPDIR", t.TempDir())
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+	opts := admission.Options{MaxCPU: 6}
+
+	spec := pool.Spec{
+		Image: "ghcr.io/cirruslabs/macos-sonoma-base:latest",
+		CPU:   4,
+	}
+
+	for _, name := range []string{pool.VMNamePrefix + "test", "gitlab-2"} {
+		require.NoError(t, backend.Clone(ctx, nil, spec.Image, name, tart.PullOptions{}))
+		require.NoError(t, backend.Set(ctx, name, tart.SetOptions{CPU: 4}))
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "output.log")
+
+	// The warm pool daemon reserves the resources of the VM it boots
+	require.NoError(t, admission.Admit(ctx, backend, pool.VMNamePrefix+"test", opts))
+	require.NoError(t, backend.Run(ctx, pool.VMNamePrefix+"test", tart.RunOptions{OutputPath: outputPath}))
+	require.NoError(t, pool.Add(pool.Entry{
+		Name:       pool.VMNamePrefix + "test",
+		Spec:       spec,
+		OutputPath: outputPath,
+		CreatedAt:  time.Now(),
+	}))
+
+	vm, err := pool.Claim(ctx, backend, spec, "gitlab-1")
+	require.NoError(t, err)
+	require.NotNil(t, vm)
+
+	// The reservation now belongs to the job's VM, so admitting it
+	// again is a no-op, while the other job's VM doesn't fit
+	require.NoError(t, admission.Admit(ctx, backend, "gitlab-1", opts))
+	require.ErrorIs(t, admission.Admit(ctx, backend, "gitlab-2", opts), admission.ErrNotAdmitted)
+}
+
+func TestNotify(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGUSR1)
+	defer signal.Stop(signalCh)
+
+	// A PID file left by a crashed daemon, whose PID is now used by another process
+	dir, err := pool.Dir()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pool.pid"), []byte(strconv.Itoa(os.Getpid())), 0600))
+
+	require.NoError(t, pool.Notify())
+
+	select {
+	case <-signalCh:
+		require.FailNow(t, "signalled a process that is not the warm pool daemon")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A running daemon is signalled
+	pidLock, err := pool.LockPIDFile()
+	require.NoError(t, err)
+	defer pidLock.Unlock()
+
+	require.NoError(t, pool.Notify())
+
+	select {
+	case <-signalCh:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the warm pool daemon was not signalled")
+	}
+
+	// Only one daemon can run at a time
+	_, err = pool.LockPIDFile()
+	require.ErrorIs(t, err, pool.ErrAlreadyRunning)
+}
+
+func TestClaimPinnedImage(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+
+	spec := pool.Spec{Image: "ghcr.io/cirruslabs/macos-sonoma-base:latest"}
+	pinnedImage := "ghcr.io/cirruslabs/macos-sonoma-base@sha256:1"
+	outputPath := filepath.Join(t.TempDir(), "output.log")
+
+	require.NoError(t, backend.Clone(ctx, nil, pinnedImage, pool.VMNamePrefix+"test", tart.PullOptions{}))
+	require.NoError(t, backend.Run(ctx, pool.VMNamePrefix+"test", tart.RunOptions{OutputPath: outputPath}))
+	require.NoError(t, pool.Add(pool.Entry{
+		Name:        pool.VMNamePrefix + "test",
+		Spec:        spec,
+		PinnedImage: pinnedImage,
+		OutputPath:  outputPath,
+		CreatedAt:   time.Now(),
+	}))
+
+	// The job's image was resolved to another digest
+	otherSpec := spec
+	otherSpec.Image = "ghcr.io/cirruslabs/macos-sonoma-base@sha256:2"
+
+	vm, err := pool.Claim(ctx, backend, otherSpec, "gitlab-1")
+	require.NoError(t, err)
+	require.Nil(t, vm)
+
+	// The job's image was resolved to the digest the VM was cloned from
+	pinnedSpec := spec
+	pinnedSpec.Image = pinnedImage
+
+	vm, err = pool.Claim(ctx, backend, pinnedSpec, "gitlab-1")
+	require.NoError(t, err)
+	require.NotNil(t, vm)
+}
@@ -0,0 +1,147 @@
+package resources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/units"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+var ErrInvalidOverride = errors.New("invalid resource override")
+
+// autoRegexp matches "auto[-RESERVE][:PERCENT%][,min=MIN]"
+var autoRegexp = regexp.MustCompile(`^auto(?:-(\d+))?(?::(\d+)%)?(?:,min=(\d+))?$`)
+
+func ParseCPUOverride(ctx context.Context, override string, concurrency uint64) (uint64, error) {
+	// No override
+	if override == "" {
+		return 0, nil
+	}
+
+	// "Auto" override
+	if strings.HasPrefix(override, "auto") {
+		count, err := cpu.CountsWithContext(ctx, true)
+		if err != nil {
+			return 0, err
+		}
+
+		//nolint:gosec // there's no overflow since cpu.CountsWithContext() returns positive values
+		return ParseAuto(override, uint64(count), concurrency)
+	}
+
+	// Exact override
+	return strconv.ParseUint(override, 10, 64)
+}
+
+func ParseMemoryOverride(ctx context.Context, override string, concurrency uint64) (uint64, error) {
+	// No override
+	if override == "" {
+		return 0, nil
+	}
+
+	// "Auto" override
+	if strings.HasPrefix(override, "auto") {
+		virtualMemoryStat, err := mem.VirtualMemoryWithContext(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		return ParseAuto(override, virtualMemoryStat.Total/uint64(units.MiB), concurrency)
+	}
+
+	// Exact override
+	return strconv.ParseUint(override, 10, 64)
+}
+
+// ParseAuto calculates the share of the total amount of the host resource
+// according to the "auto" override, which has the following syntax:
+//
+//	auto[-RESERVE][:PERCENT%][,min=MIN]
+//
+// RESERVE is the amount of the resource to leave for the host, the rest
+// of which is then either divided by the concurrency or, when PERCENT is
+// specified, multiplied by the percentage. MIN is the floor for the result.
+//
+// For example, "auto-2" on a 10-core host with the concurrency of 2
+// results in 4 CPUs, and "auto-2:25%,min=4" results in 4 CPUs too.
+func ParseAuto(override string, total uint64, concurrency uint64) (uint64, error) {
+	matches := autoRegexp.FindStringSubmatch(override)
+	if matches == nil {
+		return 0, fmt.Errorf("%w %q: expected \"auto[-RESERVE][:PERCENT%%][,min=MIN]\"",
+			ErrInvalidOverride, override)
+	}
+
+	var reserve, percent, floor uint64
+
+	for _, item := range []struct {
+		raw    string
+		result *uint64
+	}{
+		{matches[1], &reserve},
+		{matches[2], &percent},
+		{matches[3], &floor},
+	} {
+		if item.raw == "" {
+			continue
+		}
+
+		value, err := strconv.ParseUint(item.raw, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w %q: %v", ErrInvalidOverride, override, err)
+		}
+
+		*item.result = value
+	}
+
+	if reserve >= total {
+		return 0, fmt.Errorf("%w %q: reserving %d for the host leaves nothing out of %d",
+			ErrInvalidOverride, override, reserve, total)
+	}
+
+	available := total - reserve
+
+	var result uint64
+
+	switch {
+	case matches[2] != "":
+		if percent == 0 || percent > 100 {
+			return 0, fmt.Errorf("%w %q: percentage should be between 1%% and 100%%",
+				ErrInvalidOverride, override)
+		}
+
+		result = available * percent / 100
+	case concurrency == 0:
+		return 0, fmt.Errorf("%w %q: concurrency should not be zero", ErrInvalidOverride, override)
+	default:
+		result = available / concurrency
+	}
+
+	result = max(result, floor)
+
+	if result == 0 {
+		return 0, fmt.Errorf("%w %q: resolves to zero out of %d available with the concurrency of %d, "+
+			"consider adding a minimum (e.g. \"%s,min=1\")", ErrInvalidOverride, override, available,
+			concurrency, override)
+	}
+
+	return result, nil
+}
+
+// Clamp limits the value to the given bounds, where zero means no bound.
+func Clamp(value uint64, lowerBound uint64, upperBound uint64) uint64 {
+	if lowerBound != 0 && value < lowerBound {
+		return lowerBound
+	}
+
+	if upperBound != 0 && value > upperBound {
+		return upperBound
+	}
+
+	return value
+}
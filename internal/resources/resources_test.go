@@ -0,0 +1,46 @@
+package resources_test
+
+import (
+	"testing"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/resources"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClamp(t *testing.T) {
+	require.EqualValues(t, 4, resources.Clamp(4, 2, 8))
+	require.EqualValues(t, 2, resources.Clamp(1, 2, 8))
+	require.EqualValues(t, 8, resources.Clamp(16, 2, 8))
+
+	// Zero means no bound
+	require.EqualValues(t, 1, resources.Clamp(1, 0, 8))
+	require.EqualValues(t, 16, resources.Clamp(16, 2, 0))
+}
+
+func TestParseAuto(t *testing.T) {
+	for override, expected := range map[string]uint64{
+		"auto":             5,
+		"auto-2":           4,
+		"auto:50%":         5,
+		"auto-2:25%":       2,
+		"auto-2:25%,min=4": 4,
+		"auto,min=1":       5,
+	} {
+		result, err := resources.ParseAuto(override, 10, 2)
+		require.NoError(t, err, override)
+		require.Equal(t, expected, result, override)
+	}
+
+	// More concurrency than cores
+	_, err := resources.ParseAuto("auto", 4, 8)
+	require.ErrorIs(t, err, resources.ErrInvalidOverride)
+
+	result, err := resources.ParseAuto("auto,min=1", 4, 8)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, result)
+
+	for _, invalid := range []string{"automatic", "auto-10", "auto:0%", "auto:150%", "auto+2", "auto,min="} {
+		_, err := resources.ParseAuto(invalid, 10, 2)
+		require.ErrorIs(t, err, resources.ErrInvalidOverride, invalid)
+	}
+}
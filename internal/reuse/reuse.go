@@ -0,0 +1,327 @@
+package reuse
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/filelock"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/gitlab"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+)
+
+// VMNamePrefix is used for the VMs kept between the jobs, which
+// intentionally differs from the "gitlab-" prefix used for the job VMs.
+const VMNamePrefix = "tart-executor-reuse-"
+
+// StaleLeaseGracePeriod is how long the lease is protected after being
+// acquired, even if the job's VM is not running yet (e.g. when it's still
+// being cloned) or anymore (e.g. when it's being kept by the "cleanup" stage).
+const StaleLeaseGracePeriod = time.Hour
+
+// Lease tracks a VM that is kept between the jobs of a given project
+// that use a given image, and the job that is currently using it.
+type Lease struct {
+	VMName    string    `json:"vm_name"`
+	Image     string    `json:"image"`
+	Project   string    `json:"project"`
+	Jobs      uint      `json:"jobs"`
+	CreatedAt time.Time `json:"created_at"`
+	JobID     string    `json:"job_id,omitempty"`
+	LeasedAt  time.Time `json:"leased_at,omitempty"`
+
+	path string
+}
+
+// Acquire leases the VM kept for the given image and project to the job.
+// Returns nil when the VM is currently leased by another job, unless
+// that job is gone (see Stale()), in which case the lease is taken over.
+//
+//nolint:nilnil // the VM being leased by another job is not an error
+func Acquire(ctx context.Context, backend tart.Backend, image string, project string, jobID string) (*Lease, error) {
+	hash := sha256.Sum256([]byte(image + "\n" + project))
+	key := hex.EncodeToString(hash[:8])
+
+	path, err := statedir.Path("reuse", key+".json")
+	if err != nil {
+		return nil, err
+	}
+
+	var lease *Lease
+
+	err = withLock(path, func() error {
+		lease, err = read(path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+
+			lease = &Lease{
+				VMName:  VMNamePrefix + key,
+				Image:   image,
+				Project: project,
+				path:    path,
+			}
+		}
+
+		if lease.JobID != "" && lease.JobID != jobID {
+			stale, err := lease.Stale(ctx, backend, StaleLeaseGracePeriod)
+			if err != nil {
+				return err
+			}
+
+			if !stale {
+				lease = nil
+
+				return nil
+			}
+
+			log.Printf("Taking over VM %s from job %s, whose VM is no longer running...\n",
+				lease.VMName, lease.JobID)
+		}
+
+		lease.JobID = jobID
+		lease.LeasedAt = time.Now()
+
+		return lease.write()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+// Find returns the lease held by the job, if any.
+//
+//nolint:nilnil // the job not holding any leases is not an error
+func Find(jobID string) (*Lease, error) {
+	leases, err := List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lease := range leases {
+		if lease.JobID == jobID {
+			return lease, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// List returns all leases, including the ones not held by any job.
+func List() ([]*Lease, error) {
+	dir, err := statedir.Dir("reuse")
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Lease
+
+	for _, path := range paths {
+		lease, err := read(path)
+		if err != nil {
+			log.Printf("Skipping unreadable lease %s: %v\n", path, err)
+
+			continue
+		}
+
+		result = append(result, lease)
+	}
+
+	return result, nil
+}
+
+// Stale returns true when the lease is held by a job that is gone, for example,
+// due to the GitLab Runner crash or the host reboot, which is when the job's VM
+// is not running for longer than the grace period since the lease was acquired.
+func (lease *Lease) Stale(ctx context.Context, backend tart.Backend, gracePeriod time.Duration) (bool, error) {
+	if lease.JobID == "" || time.Since(lease.LeasedAt) < gracePeriod {
+		return false, nil
+	}
+
+	listEntries, err := backend.List(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	jobVMName := gitlab.VirtualMachineIDPrefix + lease.JobID
+
+	for _, listEntry := range listEntries {
+		if listEntry.Source == "local" && listEntry.Name == jobVMName && listEntry.Running {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Revoke takes the stale lease away from the job that held it, keeping the
+// VM for the subsequent jobs if it still exists and forgetting it otherwise.
+// Does nothing if the lease has been acquired by another job in the meantime.
+func (lease *Lease) Revoke(ctx context.Context, backend tart.Backend) error {
+	return withLock(lease.path, func() error {
+		current, err := read(lease.path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if current.JobID != lease.JobID {
+			return nil
+		}
+
+		listEntries, err := backend.List(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, listEntry := range listEntries {
+			if listEntry.Source == "local" && listEntry.Name == current.VMName {
+				current.JobID = ""
+
+				return current.write()
+			}
+		}
+
+		return os.Remove(lease.path)
+	})
+}
+
+// Delete deletes the kept VM and forgets it, unless the lease has been
+// acquired by a job in the meantime, in which case false is returned.
+func (lease *Lease) Delete(ctx context.Context, backend tart.Backend) (bool, error) {
+	var deleted bool
+
+	err := withLock(lease.path, func() error {
+		current, err := read(lease.path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if current.JobID != "" {
+			return nil
+		}
+
+		listEntries, err := backend.List(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, listEntry := range listEntries {
+			if listEntry.Source != "local" || listEntry.Name != current.VMName {
+				continue
+			}
+
+			if listEntry.Running {
+				if err := backend.Stop(ctx, current.VMName); err != nil {
+					return err
+				}
+			}
+
+			if err := backend.Delete(ctx, current.VMName); err != nil {
+				return err
+			}
+		}
+
+		deleted = true
+
+		return os.Remove(lease.path)
+	})
+
+	return deleted, err
+}
+
+// Expired returns true if the VM should not be used for more jobs.
+func (lease *Lease) Expired(maxJobs uint, maxAge time.Duration) bool {
+	if maxJobs != 0 && lease.Jobs >= maxJobs {
+		return true
+	}
+
+	if maxAge != 0 && time.Since(lease.CreatedAt) >= maxAge {
+		return true
+	}
+
+	return false
+}
+
+// Reset starts the lease from scratch, e.g. when the VM was re-created.
+func (lease *Lease) Reset() {
+	lease.Jobs = 0
+	lease.CreatedAt = time.Now()
+}
+
+// Save persists the changes made to the lease.
+func (lease *Lease) Save() error {
+	return withLock(lease.path, lease.write)
+}
+
+// Release makes the VM available to the subsequent jobs.
+func (lease *Lease) Release() error {
+	lease.JobID = ""
+
+	return lease.Save()
+}
+
+// Discard forgets the VM, e.g. when it was deleted.
+func (lease *Lease) Discard() error {
+	return withLock(lease.path, func() error {
+		return os.Remove(lease.path)
+	})
+}
+
+func (lease *Lease) write() error {
+	leaseBytes, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(lease.path, leaseBytes, 0600)
+}
+
+func read(path string) (*Lease, error) {
+	leaseBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &Lease{
+		path: path,
+	}
+
+	if err := json.Unmarshal(leaseBytes, lease); err != nil {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+func withLock(path string, fn func() error) error {
+	lock, err := filelock.Lock(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	return fn()
+}
@@ -0,0 +1,125 @@
+package reuse_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/reuse"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLease(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+
+	const image = "ghcr.io/cirruslabs/macos-sonoma-xcode:latest"
+
+	lease, err := reuse.Acquire(ctx, backend, image, "infra/ios-app", "1")
+	require.NoError(t, err)
+	require.NotNil(t, lease)
+	require.Zero(t, lease.Jobs)
+
+	lease.Reset()
+	lease.Jobs++
+	require.NoError(t, lease.Save())
+
+	// Only one job can use the VM at a time
+	otherLease, err := reuse.Acquire(ctx, backend, image, "infra/ios-app", "2")
+	require.NoError(t, err)
+	require.Nil(t, otherLease)
+
+	// Other projects get their own VM
+	otherLease, err = reuse.Acquire(ctx, backend, image, "infra/android-app", "2")
+	require.NoError(t, err)
+	require.NotNil(t, otherLease)
+	require.NotEqual(t, lease.VMName, otherLease.VMName)
+
+	foundLease, err := reuse.Find("1")
+	require.NoError(t, err)
+	require.Equal(t, lease.VMName, foundLease.VMName)
+
+	require.NoError(t, foundLease.Release())
+
+	lease, err = reuse.Acquire(ctx, backend, image, "infra/ios-app", "3")
+	require.NoError(t, err)
+	require.NotNil(t, lease)
+	require.EqualValues(t, 1, lease.Jobs)
+
+	require.False(t, lease.Expired(0, 0))
+	require.True(t, lease.Expired(1, 0))
+	require.False(t, lease.Expired(2, time.Hour))
+	require.True(t, lease.Expired(2, time.Nanosecond))
+}
+
+func TestLeaseStale(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+
+	const image = "ghcr.io/cirruslabs/macos-sonoma-xcode:latest"
+
+	lease, err := reuse.Acquire(ctx, backend, image, "infra/ios-app", "1")
+	require.NoError(t, err)
+	require.NotNil(t, lease)
+
+	// The job's VM is running, so the lease is not stale
+	// no matter how long ago it was acquired
+	require.NoError(t, backend.Clone(ctx, nil, image, "gitlab-1", tart.PullOptions{}))
+	require.NoError(t, backend.Run(ctx, "gitlab-1", tart.RunOptions{}))
+
+	lease.LeasedAt = time.Now().Add(-2 * reuse.StaleLeaseGracePeriod)
+	require.NoError(t, lease.Save())
+
+	otherLease, err := reuse.Acquire(ctx, backend, image, "infra/ios-app", "2")
+	require.NoError(t, err)
+	require.Nil(t, otherLease)
+
+	// The job is gone, so the lease is taken over
+	require.NoError(t, backend.Delete(ctx, "gitlab-1"))
+
+	stale, err := lease.Stale(ctx, backend, reuse.StaleLeaseGracePeriod)
+	require.NoError(t, err)
+	require.True(t, stale)
+
+	otherLease, err = reuse.Acquire(ctx, backend, image, "infra/ios-app", "2")
+	require.NoError(t, err)
+	require.NotNil(t, otherLease)
+	require.Equal(t, "2", otherLease.JobID)
+
+	// The freshly acquired lease is protected by the grace period
+	stale, err = otherLease.Stale(ctx, backend, reuse.StaleLeaseGracePeriod)
+	require.NoError(t, err)
+	require.False(t, stale)
+}
+
+func TestLeaseRevoke(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+
+	const image = "ghcr.io/cirruslabs/macos-sonoma-xcode:latest"
+
+	keptLease, err := reuse.Acquire(ctx, backend, image, "infra/ios-app", "1")
+	require.NoError(t, err)
+	require.NoError(t, backend.Clone(ctx, nil, image, keptLease.VMName, tart.PullOptions{}))
+
+	goneLease, err := reuse.Acquire(ctx, backend, image, "infra/android-app", "2")
+	require.NoError(t, err)
+
+	require.NoError(t, keptLease.Revoke(ctx, backend))
+	require.NoError(t, goneLease.Revoke(ctx, backend))
+
+	// The VM that still exists is kept for the subsequent jobs
+	leases, err := reuse.List()
+	require.NoError(t, err)
+	require.Len(t, leases, 1)
+	require.Equal(t, keptLease.VMName, leases[0].VMName)
+	require.Empty(t, leases[0].JobID)
+}
@@ -0,0 +1,9 @@
+package shell
+
+import "strings"
+
+// Quote quotes the string for the POSIX-compatible shells,
+// so that it's passed as a single word as is.
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,14 @@
+package shell_test
+
+import (
+	"testing"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/shell"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuote(t *testing.T) {
+	require.Equal(t, `''`, shell.Quote(""))
+	require.Equal(t, `'Europe/Berlin'`, shell.Quote("Europe/Berlin"))
+	require.Equal(t, `'it'\''s $HOME'`, shell.Quote("it's $HOME"))
+}
@@ -0,0 +1,77 @@
+package statedir
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+var dir string
+
+func IntroduceFlag(command *cobra.Command) {
+	command.PersistentFlags().StringVar(&dir, "state-dir", "",
+		"path to a host-level directory for the state shared between executor invocations "+
+			"(defaults to \"gitlab-tart-executor\" directory in the user's cache directory)")
+}
+
+// Override sets the state directory just like the --state-dir command-line
+// argument does and returns a function that restores the previous one, which
+// is useful for the tests: the default directory ignores XDG_CACHE_HOME on macOS.
+func Override(path string) func() {
+	previous := dir
+	dir = path
+
+	return func() {
+		dir = previous
+	}
+}
+
+// Path returns a path to a file inside the host-level state directory,
+// creating the parent directories if they don't exist yet.
+//
+// Note that we can't use os.TempDir() for this purpose because
+// GitLab Runner redefines the TMPDIR environment variable for
+// each job, see tart.VM's TartRunOutputPath() for more details.
+func Path(elem ...string) (string, error) {
+	result, err := join(elem...)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(result), 0700); err != nil {
+		return "", err
+	}
+
+	return result, nil
+}
+
+// Dir is similar to Path, but returns a path to a directory
+// inside the host-level state directory and creates it too.
+func Dir(elem ...string) (string, error) {
+	result, err := join(elem...)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(result, 0700); err != nil {
+		return "", err
+	}
+
+	return result, nil
+}
+
+func join(elem ...string) (string, error) {
+	root := dir
+
+	if root == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+
+		root = filepath.Join(userCacheDir, "gitlab-tart-executor")
+	}
+
+	return filepath.Join(append([]string{root}, elem...)...), nil
+}
@@ -0,0 +1,89 @@
+package tart
+
+import (
+	"context"
+	"time"
+)
+
+// Backend abstracts the Tart runtime, so that the VM lifecycle
+// can be driven by something other than the "tart" command,
+// for example, by a FakeBackend in tests.
+type Backend interface {
+	Clone(ctx context.Context, env map[string]string, source string, name string, opts PullOptions) error
+	Set(ctx context.Context, name string, opts SetOptions) error
+	Run(ctx context.Context, name string, opts RunOptions) error
+	IP(ctx context.Context, name string, opts IPOptions) (string, error)
+	Get(ctx context.Context, name string) (*VMInfo, error)
+	Stop(ctx context.Context, name string) error
+	Delete(ctx context.Context, name string) error
+	Rename(ctx context.Context, name string, newName string) error
+	Pull(ctx context.Context, env map[string]string, image string, opts PullOptions) error
+	FQN(ctx context.Context, image string) (string, error)
+	List(ctx context.Context) ([]ListEntry, error)
+}
+
+// DefaultBackend is the Backend used by the executor stages.
+var DefaultBackend Backend = &ExecBackend{}
+
+type PullOptions struct {
+	Insecure    bool
+	Concurrency uint8
+
+	// Retries and RetryDelay configure the retrying of the transient
+	// failures (see IsRetryable) by PullIfNeeded() and CreateNewVM()
+	Retries    uint
+	RetryDelay time.Duration
+}
+
+type SetOptions struct {
+	CPU       uint64
+	Memory    uint64
+	DiskSize  uint64
+	RandomMAC bool
+	Display   string
+}
+
+type RunOptions struct {
+	// Args are the command-line arguments to pass to "tart run"
+	// before the VM name (e.g. "--no-graphics").
+	Args []string
+
+	// Env contains environment variable overrides
+	// in the "KEY=value" form.
+	Env []string
+
+	// OutputPath is a file to which the VM's output
+	// will be appended.
+	OutputPath string
+
+	// PIDPath is a file to which the PID of the process
+	// running the VM will be written, if not empty.
+	PIDPath string
+}
+
+type IPOptions struct {
+	Wait     uint
+	Resolver string
+}
+
+type VMInfo struct {
+	OS     string `json:"os"`
+	CPU    uint64 `json:"cpu"`
+	Memory uint64 `json:"memory"`
+	Disk   uint64 `json:"disk"`
+}
+
+type ListEntry struct {
+	Source   string `json:"Source"`
+	Name     string `json:"Name"`
+	Disk     int    `json:"Disk"`
+	Size     int    `json:"Size"`
+	Accessed string `json:"Accessed"`
+	Running  bool   `json:"Running"`
+	State    string `json:"State"`
+}
+
+// AccessedAt parses the time at which the VM or the image was last accessed.
+func (entry ListEntry) AccessedAt() (time.Time, error) {
+	return time.Parse(time.RFC3339, entry.Accessed)
+}
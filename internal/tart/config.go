@@ -4,6 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"github.com/caarlos0/env/v8"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/configfile"
+	"os"
+	"strings"
+	"time"
 )
 
 var ErrConfigFromEnvironmentFailed = errors.New("failed to load config from environment")
@@ -40,34 +44,139 @@ const (
 	EnvTartExecutorInternalCacheDirOnHost = "TART_EXECUTOR_INTERNAL_CACHE_DIR_ON_HOST"
 )
 
+const (
+	DefaultIPTimeout     = 60 * time.Second
+	DefaultBootTimeout   = 10 * time.Minute
+	DefaultSSHRetryDelay = time.Second
+)
+
 type Config struct {
-	SSHUsername         string `env:"SSH_USERNAME" envDefault:"admin"`
-	SSHPassword         string `env:"SSH_PASSWORD" envDefault:"admin"`
-	SSHPort             uint16 `env:"SSH_PORT" envDefault:"22"`
-	Bridged             string `env:"BRIDGED"`
-	Softnet             bool   `env:"SOFTNET"`
-	SoftnetAllow        string `env:"SOFTNET_ALLOW"`
-	Headless            bool   `env:"HEADLESS"  envDefault:"true"`
-	RandomMAC           bool   `env:"RANDOM_MAC"  envDefault:"true"`
-	RootDiskOpts        string `env:"ROOT_DISK_OPTS"`
-	AlwaysPull          bool   `env:"ALWAYS_PULL"  envDefault:"true"`
-	InsecurePull        bool   `env:"INSECURE_PULL"  envDefault:"false"`
-	PullConcurrency     uint8  `env:"PULL_CONCURRENCY"`
-	HostDir             bool   `env:"HOST_DIR"`
-	Shell               string `env:"SHELL"`
-	InstallGitlabRunner string `env:"INSTALL_GITLAB_RUNNER"`
-	Timezone            string `env:"TIMEZONE"`
-	Display             string `env:"DISPLAY"`
+	SSHUsername             string `env:"SSH_USERNAME" envDefault:"admin"`
+	SSHPassword             string `env:"SSH_PASSWORD" envDefault:"admin"`
+	SSHPrivateKey           string `env:"SSH_PRIVATE_KEY"`
+	SSHPrivateKeyFile       string `env:"SSH_PRIVATE_KEY_FILE"`
+	SSHPrivateKeyPassphrase string `env:"SSH_PRIVATE_KEY_PASSPHRASE"`
+	SSHAgent                bool   `env:"SSH_AGENT"`
+	SSHPort                 uint16 `env:"SSH_PORT" envDefault:"22"`
+	Bridged                 string `env:"BRIDGED"`
+	Softnet                 bool   `env:"SOFTNET"`
+	SoftnetAllow            string `env:"SOFTNET_ALLOW"`
+	Headless                bool   `env:"HEADLESS"  envDefault:"true"`
+	RandomMAC               bool   `env:"RANDOM_MAC"  envDefault:"true"`
+	RootDiskOpts            string `env:"ROOT_DISK_OPTS"`
+	AlwaysPull              bool   `env:"ALWAYS_PULL"  envDefault:"true"`
+	RawPullPolicy           string `env:"PULL_POLICY"`
+	InsecurePull            bool   `env:"INSECURE_PULL"  envDefault:"false"`
+	PullConcurrency         uint8  `env:"PULL_CONCURRENCY"`
+	PullRetries             uint   `env:"PULL_RETRIES" envDefault:"3"`
+	HostDir                 bool   `env:"HOST_DIR"`
+	Shell                   string `env:"SHELL"`
+	InstallGitlabRunner     string `env:"INSTALL_GITLAB_RUNNER"`
+	Timezone                string `env:"TIMEZONE"`
+	Display                 string `env:"DISPLAY"`
+	PrepareScript           string `env:"PREPARE_SCRIPT"`
+
+	// CPU and Memory are the job's requests for the VM size,
+	// which take precedence over the "prepare" stage's "--cpu"
+	// and "--memory" command-line arguments when specified
+	CPU    string `env:"CPU"`
+	Memory string `env:"MEMORY"`
+
+	// DiskSize is the job's request for the VM's disk size in gigabytes,
+	// which takes precedence over the "prepare" stage's "--disk-size"
+	DiskSize uint64 `env:"DISK_SIZE"`
+
+	// Zero values mean that the command-line arguments should be
+	// used instead (see SetDefaultTimeouts()), or, if there are no
+	// such arguments, that the Default* constants should be used
+	IPTimeout     time.Duration `env:"IP_TIMEOUT"`
+	BootTimeout   time.Duration `env:"BOOT_TIMEOUT"`
+	SSHRetryDelay time.Duration `env:"SSH_RETRY_DELAY"`
+
+	PullRetryDelay time.Duration `env:"PULL_RETRY_DELAY" envDefault:"5s"`
+
+	// sshPasswordSet is true when the SSH password was explicitly
+	// provided by the user and not just defaulted.
+	sshPasswordSet bool
+}
+
+// RunSettings is a subset of Config that is applied when the VM
+// is cloned and started, and thus can't be changed afterwards.
+type RunSettings struct {
+	Bridged      string
+	Softnet      bool
+	SoftnetAllow string
+	Headless     bool
+	RandomMAC    bool
+	RootDiskOpts string
+	Display      string
+	DiskSize     uint64
+}
+
+func (config Config) RunSettings() RunSettings {
+	return RunSettings{
+		Bridged:      config.Bridged,
+		Softnet:      config.Softnet,
+		SoftnetAllow: config.SoftnetAllow,
+		Headless:     config.Headless,
+		RandomMAC:    config.RandomMAC,
+		RootDiskOpts: config.RootDiskOpts,
+		Display:      config.Display,
+		DiskSize:     config.DiskSize,
+	}
+}
+
+func (config Config) PullOptions() PullOptions {
+	return PullOptions{
+		Insecure:    config.InsecurePull,
+		Concurrency: config.PullConcurrency,
+		Retries:     config.PullRetries,
+		RetryDelay:  config.PullRetryDelay,
+	}
+}
+
+// SetDefaultTimeouts sets the timeouts that were not overridden by the job.
+func (config *Config) SetDefaultTimeouts(ipTimeout, bootTimeout, sshRetryDelay time.Duration) {
+	if config.IPTimeout == 0 {
+		config.IPTimeout = ipTimeout
+	}
+
+	if config.BootTimeout == 0 {
+		config.BootTimeout = bootTimeout
+	}
+
+	if config.SSHRetryDelay == 0 {
+		config.SSHRetryDelay = sshRetryDelay
+	}
 }
 
 func NewConfigFromEnvironment() (Config, error) {
 	var config Config
 
+	// The defaults from the configuration file can be overridden by the job
+	environment := map[string]string{}
+
+	for key, value := range configfile.Defaults() {
+		environment[envPrefixGitLabRunner+key] = value
+	}
+
+	for _, keyAndValue := range os.Environ() {
+		key, value, _ := strings.Cut(keyAndValue, "=")
+		environment[key] = value
+	}
+
+	if err := applyPolicy(configfile.GetPolicy(), environment); err != nil {
+		return config, err
+	}
+
 	if err := env.ParseWithOptions(&config, env.Options{
-		Prefix: envPrefixGitLabRunner + envPrefixTartExecutor,
+		Prefix:      envPrefixGitLabRunner + envPrefixTartExecutor,
+		Environment: environment,
 	}); err != nil {
 		return config, fmt.Errorf("%w: %v", ErrConfigFromEnvironmentFailed, err)
 	}
 
+	_, config.sshPasswordSet = environment[envPrefixGitLabRunner+envPrefixTartExecutor+"SSH_PASSWORD"]
+
 	return config, nil
 }
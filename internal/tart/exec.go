@@ -0,0 +1,292 @@
+package tart
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	TartCommandName         = "tart"
+	TartCommandHomebrewPath = "/opt/homebrew/bin/tart"
+)
+
+// ExecBackend is a Backend that invokes the "tart" command.
+type ExecBackend struct{}
+
+func (backend *ExecBackend) Clone(
+	ctx context.Context,
+	env map[string]string,
+	source string,
+	name string,
+	opts PullOptions,
+) error {
+	cloneArgs := append([]string{"clone", source, name}, opts.args()...)
+
+	_, _, err := backend.exec(ctx, env, cloneArgs...)
+
+	return err
+}
+
+func (backend *ExecBackend) Set(ctx context.Context, name string, opts SetOptions) error {
+	var setArgs []string
+
+	if opts.CPU != 0 {
+		setArgs = append(setArgs, "--cpu", strconv.FormatUint(opts.CPU, 10))
+	}
+
+	if opts.Memory != 0 {
+		setArgs = append(setArgs, "--memory", strconv.FormatUint(opts.Memory, 10))
+	}
+
+	if opts.DiskSize != 0 {
+		setArgs = append(setArgs, "--disk-size", strconv.FormatUint(opts.DiskSize, 10))
+	}
+
+	if opts.RandomMAC {
+		setArgs = append(setArgs, "--random-mac")
+	}
+
+	if opts.Display != "" {
+		setArgs = append(setArgs, "--display", opts.Display)
+	}
+
+	if len(setArgs) == 0 {
+		return nil
+	}
+
+	setArgs = append(append([]string{"set"}, setArgs...), name)
+
+	_, _, err := backend.exec(ctx, nil, setArgs...)
+
+	return err
+}
+
+// Run starts "tart run" in a separate session and returns without
+// waiting for it to finish, since the VM needs to outlive the current
+// stage. The context is therefore not used to control the process.
+func (backend *ExecBackend) Run(_ context.Context, name string, opts RunOptions) error {
+	tartCommandPath, err := tartCommandPath()
+	if err != nil {
+		return err
+	}
+
+	runArgs := append(append([]string{"run"}, opts.Args...), name)
+
+	//nolint:gosec,noctx // it's OK to launch a subrocess with variable, plus we can't use context.Context here
+	cmd := exec.Command(tartCommandPath, runArgs...)
+
+	// Base environment
+	cmd.Env = cmd.Environ()
+
+	// Environment overrides
+	cmd.Env = append(cmd.Env, opts.Env...)
+
+	outputFile, err := os.OpenFile(opts.OutputPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	cmd.Stdout = outputFile
+	cmd.Stderr = outputFile
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	// Reap the process if it exits while we're still running,
+	// otherwise it will linger as a zombie and will look alive
+	// when checked by the PID, see VM's tartRunExited()
+	go func() {
+		_ = cmd.Wait()
+	}()
+
+	if opts.PIDPath != "" {
+		//nolint:gosec // G306 shouldn't apply here as we're not writing anything sensitive
+		if err := os.WriteFile(opts.PIDPath, fmt.Appendf(nil, "%d\n", cmd.Process.Pid), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (backend *ExecBackend) IP(ctx context.Context, name string, opts IPOptions) (string, error) {
+	stdout, _, err := backend.exec(ctx, nil, "ip", "--wait", strconv.FormatUint(uint64(opts.Wait), 10),
+		"--resolver", opts.Resolver, name)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(stdout), nil
+}
+
+func (backend *ExecBackend) Get(ctx context.Context, name string) (*VMInfo, error) {
+	stdout, _, err := backend.exec(ctx, nil, "get", "--format", "json", name)
+	if err != nil {
+		return nil, err
+	}
+
+	var vmInfo VMInfo
+
+	if err := json.Unmarshal([]byte(stdout), &vmInfo); err != nil {
+		return nil, err
+	}
+
+	return &vmInfo, nil
+}
+
+func (backend *ExecBackend) Stop(ctx context.Context, name string) error {
+	_, _, err := backend.exec(ctx, nil, "stop", name)
+
+	return err
+}
+
+func (backend *ExecBackend) Delete(ctx context.Context, name string) error {
+	_, _, err := backend.exec(ctx, nil, "delete", name)
+
+	return err
+}
+
+func (backend *ExecBackend) Rename(ctx context.Context, name string, newName string) error {
+	_, _, err := backend.exec(ctx, nil, "rename", name, newName)
+
+	return err
+}
+
+func (backend *ExecBackend) Pull(
+	ctx context.Context,
+	env map[string]string,
+	image string,
+	opts PullOptions,
+) error {
+	pullArgs := append([]string{"pull", image}, opts.args()...)
+
+	_, _, err := backend.exec(ctx, env, pullArgs...)
+
+	return err
+}
+
+// FQN resolves the already pulled image to a digest-pinned reference.
+func (backend *ExecBackend) FQN(ctx context.Context, image string) (string, error) {
+	stdout, _, err := backend.exec(ctx, nil, "fqn", image)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(stdout), nil
+}
+
+func (backend *ExecBackend) List(ctx context.Context) ([]ListEntry, error) {
+	stdout, _, err := backend.exec(ctx, nil, "list", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ListEntry
+
+	if err := json.Unmarshal([]byte(stdout), &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (backend *ExecBackend) exec(
+	ctx context.Context,
+	env map[string]string,
+	args ...string,
+) (string, string, error) {
+	tartCommandPath, err := tartCommandPath()
+	if err != nil {
+		return "", "", err
+	}
+
+	//nolint:gosec // it's OK to launch a subrocess with variable
+	cmd := exec.CommandContext(ctx, tartCommandPath, args...)
+
+	// Base environment
+	cmd.Env = cmd.Environ()
+
+	// Environment overrides
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		var exitError *exec.ExitError
+
+		if errors.As(err, &exitError) {
+			// Tart command failed, redefine the error
+			// to be the Tart-specific output
+			err = fmt.Errorf("%w: %q", ErrTartFailed, firstNonEmptyLine(stderr.String(), stdout.String()))
+		}
+	}
+
+	return stdout.String(), stderr.String(), err
+}
+
+func (opts PullOptions) args() []string {
+	var args []string
+
+	if opts.Insecure {
+		args = append(args, "--insecure")
+	}
+
+	if opts.Concurrency != 0 {
+		args = append(args, "--concurrency", strconv.FormatUint(uint64(opts.Concurrency), 10))
+	}
+
+	return args
+}
+
+func firstNonEmptyLine(outputs ...string) string {
+	for _, output := range outputs {
+		for line := range strings.SplitSeq(output, "\n") {
+			if line != "" {
+				return line
+			}
+		}
+	}
+
+	return ""
+}
+
+func tartCommandPath() (string, error) {
+	result, err := exec.LookPath(TartCommandName)
+	if err != nil {
+		// Perhaps GitLab Runner was invoked from a launchd user agent
+		// with a limited PATH[1], check if Tart is available in the
+		// Homebrew's binary directory before completely failing.
+		//
+		// [1]: https://github.com/cirruslabs/gitlab-tart-executor/issues/47
+		_, err := os.Stat(TartCommandHomebrewPath)
+		if err == nil {
+			return TartCommandHomebrewPath, nil
+		}
+
+		return "", fmt.Errorf("%w: %s command not found in PATH, make sure Tart is installed",
+			ErrTartNotFound, TartCommandName)
+	}
+
+	return result, nil
+}
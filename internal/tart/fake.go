@@ -0,0 +1,369 @@
+package tart
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeBackend is an in-memory Backend that doesn't require Tart
+// to be installed, which is useful for testing the executor stages.
+type FakeBackend struct {
+	// IPAddress is returned by IP() for running VMs.
+	IPAddress string
+
+	// OS is reported by Get() for all VMs.
+	OS string
+
+	// Digests are reported by FQN() for the pulled images, with
+	// the SHA-256 of the image name being used for the rest.
+	Digests map[string]string
+
+	// Sizes are reported by List() for the pulled images, in gigabytes.
+	Sizes map[string]int
+
+	// DiskSize is the disk size in gigabytes of the VMs cloned
+	// from the images, the VMs cloned from other VMs inherit it.
+	DiskSize uint64
+
+	mtx    sync.Mutex
+	vms    map[string]*FakeVM
+	images map[string]time.Time
+}
+
+type FakeVM struct {
+	Source    string
+	CPU       uint64
+	Memory    uint64
+	DiskSize  uint64
+	RandomMAC bool
+	Display   string
+	Running   bool
+	RunArgs   []string
+	RunEnv    []string
+	Accessed  time.Time
+}
+
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		IPAddress: "127.0.0.1",
+		OS:        "darwin",
+		Digests:   map[string]string{},
+		Sizes:     map[string]int{},
+		vms:       map[string]*FakeVM{},
+		images:    map[string]time.Time{},
+	}
+}
+
+// VM returns a snapshot of the VM's state for inspection.
+func (backend *FakeBackend) VM(name string) (FakeVM, bool) {
+	backend.mtx.Lock()
+	defer backend.mtx.Unlock()
+
+	vm, ok := backend.vms[name]
+	if !ok {
+		return FakeVM{}, false
+	}
+
+	return *vm, true
+}
+
+func (backend *FakeBackend) Clone(
+	_ context.Context,
+	_ map[string]string,
+	source string,
+	name string,
+	_ PullOptions,
+) error {
+	backend.mtx.Lock()
+	defer backend.mtx.Unlock()
+
+	if _, ok := backend.vms[name]; ok {
+		return fmt.Errorf("%w: VM %q already exists", ErrTartFailed, name)
+	}
+
+	diskSize := backend.DiskSize
+
+	// "tart clone" automatically pulls remote images
+	if sourceVM, ok := backend.vms[source]; ok {
+		diskSize = sourceVM.DiskSize
+	} else {
+		backend.images[source] = time.Now()
+	}
+
+	backend.vms[name] = &FakeVM{
+		Source:   source,
+		DiskSize: diskSize,
+		Accessed: time.Now(),
+	}
+
+	return nil
+}
+
+func (backend *FakeBackend) Set(_ context.Context, name string, opts SetOptions) error {
+	backend.mtx.Lock()
+	defer backend.mtx.Unlock()
+
+	vm, err := backend.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	if opts.CPU != 0 {
+		vm.CPU = opts.CPU
+	}
+
+	if opts.Memory != 0 {
+		vm.Memory = opts.Memory
+	}
+
+	if opts.DiskSize != 0 {
+		if opts.DiskSize < vm.DiskSize {
+			return fmt.Errorf("%w: disk of VM %q can only be grown", ErrTartFailed, name)
+		}
+
+		vm.DiskSize = opts.DiskSize
+	}
+
+	if opts.RandomMAC {
+		vm.RandomMAC = true
+	}
+
+	if opts.Display != "" {
+		vm.Display = opts.Display
+	}
+
+	return nil
+}
+
+func (backend *FakeBackend) Run(_ context.Context, name string, opts RunOptions) error {
+	backend.mtx.Lock()
+	defer backend.mtx.Unlock()
+
+	vm, err := backend.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	if vm.Running {
+		return fmt.Errorf("%w: VM %q is already running", ErrTartFailed, name)
+	}
+
+	// Make sure that the output can be monitored just like with a real VM
+	if opts.OutputPath != "" {
+		outputFile, err := os.OpenFile(opts.OutputPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+
+		if err := outputFile.Close(); err != nil {
+			return err
+		}
+	}
+
+	// There's no process running the VM, so use
+	// our own PID which is alive for as long as needed
+	if opts.PIDPath != "" {
+		if err := os.WriteFile(opts.PIDPath, fmt.Appendf(nil, "%d\n", os.Getpid()), 0600); err != nil {
+			return err
+		}
+	}
+
+	vm.Running = true
+	vm.RunArgs = slices.Clone(opts.Args)
+	vm.RunEnv = slices.Clone(opts.Env)
+	vm.Accessed = time.Now()
+
+	return nil
+}
+
+func (backend *FakeBackend) IP(_ context.Context, name string, _ IPOptions) (string, error) {
+	backend.mtx.Lock()
+	defer backend.mtx.Unlock()
+
+	vm, err := backend.lookup(name)
+	if err != nil {
+		return "", err
+	}
+
+	if !vm.Running {
+		return "", fmt.Errorf("%w: VM %q is not running", ErrTartFailed, name)
+	}
+
+	return backend.IPAddress, nil
+}
+
+func (backend *FakeBackend) Get(_ context.Context, name string) (*VMInfo, error) {
+	backend.mtx.Lock()
+	defer backend.mtx.Unlock()
+
+	vm, err := backend.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VMInfo{
+		OS:     backend.OS,
+		CPU:    vm.CPU,
+		Memory: vm.Memory,
+		Disk:   vm.DiskSize,
+	}, nil
+}
+
+func (backend *FakeBackend) Stop(_ context.Context, name string) error {
+	backend.mtx.Lock()
+	defer backend.mtx.Unlock()
+
+	vm, err := backend.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	if !vm.Running {
+		return fmt.Errorf("%w: VM %q is not running", ErrTartFailed, name)
+	}
+
+	vm.Running = false
+
+	return nil
+}
+
+func (backend *FakeBackend) Delete(_ context.Context, name string) error {
+	backend.mtx.Lock()
+	defer backend.mtx.Unlock()
+
+	if _, ok := backend.images[name]; ok {
+		delete(backend.images, name)
+
+		return nil
+	}
+
+	if _, err := backend.lookup(name); err != nil {
+		return err
+	}
+
+	delete(backend.vms, name)
+
+	return nil
+}
+
+func (backend *FakeBackend) Rename(_ context.Context, name string, newName string) error {
+	backend.mtx.Lock()
+	defer backend.mtx.Unlock()
+
+	vm, err := backend.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := backend.vms[newName]; ok {
+		return fmt.Errorf("%w: VM %q already exists", ErrTartFailed, newName)
+	}
+
+	delete(backend.vms, name)
+	backend.vms[newName] = vm
+
+	return nil
+}
+
+func (backend *FakeBackend) Pull(
+	_ context.Context,
+	_ map[string]string,
+	image string,
+	_ PullOptions,
+) error {
+	backend.mtx.Lock()
+	defer backend.mtx.Unlock()
+
+	backend.images[image] = time.Now()
+
+	// Similarly to Tart, the image is also available by its digest
+	backend.images[backend.fqn(image)] = time.Now()
+
+	return nil
+}
+
+func (backend *FakeBackend) FQN(_ context.Context, image string) (string, error) {
+	backend.mtx.Lock()
+	defer backend.mtx.Unlock()
+
+	if _, ok := backend.images[image]; !ok {
+		return "", fmt.Errorf("%w: image %q is not pulled", ErrTartFailed, image)
+	}
+
+	return backend.fqn(image), nil
+}
+
+func (backend *FakeBackend) fqn(image string) string {
+	if strings.Contains(image, "@") {
+		return image
+	}
+
+	digest, ok := backend.Digests[image]
+	if !ok {
+		hash := sha256.Sum256([]byte(image))
+		digest = "sha256:" + hex.EncodeToString(hash[:])
+	}
+
+	// Strip the tag, if any
+	repository := image
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		repository = image[:i]
+	}
+
+	return repository + "@" + digest
+}
+
+func (backend *FakeBackend) List(_ context.Context) ([]ListEntry, error) {
+	backend.mtx.Lock()
+	defer backend.mtx.Unlock()
+
+	var entries []ListEntry
+
+	for name, accessed := range backend.images {
+		entries = append(entries, ListEntry{
+			Source:   "OCI",
+			Name:     name,
+			Size:     backend.Sizes[name],
+			Accessed: accessed.Format(time.RFC3339),
+			State:    "stopped",
+		})
+	}
+
+	for name, vm := range backend.vms {
+		state := "stopped"
+		if vm.Running {
+			state = "running"
+		}
+
+		entries = append(entries, ListEntry{
+			Source:   "local",
+			Name:     name,
+			Accessed: vm.Accessed.Format(time.RFC3339),
+			Running:  vm.Running,
+			State:    state,
+		})
+	}
+
+	slices.SortFunc(entries, func(a, b ListEntry) int {
+		return cmp.Or(cmp.Compare(a.Source, b.Source), cmp.Compare(a.Name, b.Name))
+	})
+
+	return entries, nil
+}
+
+func (backend *FakeBackend) lookup(name string) (*FakeVM, error) {
+	vm, ok := backend.vms[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: VM %q does not exist", ErrTartFailed, name)
+	}
+
+	return vm, nil
+}
@@ -0,0 +1,83 @@
+package tart
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var ErrHostKeyMismatch = errors.New("VM's SSH host key does not match")
+
+// HostKeyCallback returns an SSH host key callback for the VM.
+//
+// When knownHostsPaths are provided, the host key is verified against
+// these known_hosts files, which is useful for images with baked host
+// keys or host certificates (see "@cert-authority" marker in sshd(8)),
+// and with record set to true the verified host key is also pinned, so
+// that the subsequent stages can connect without the known_hosts files.
+//
+// Otherwise, the trust-on-first-use approach is used: with record set
+// to true, the host key is accepted and pinned for the subsequent
+// stages, and with record set to false the host key is verified
+// against the previously pinned one.
+func (vm *VM) HostKeyCallback(knownHostsPaths []string, record bool) (ssh.HostKeyCallback, error) {
+	if len(knownHostsPaths) != 0 {
+		knownHostsCallback, err := knownhosts.New(knownHostsPaths...)
+		if err != nil {
+			return nil, err
+		}
+
+		if !record {
+			return knownHostsCallback, nil
+		}
+
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if err := knownHostsCallback(hostname, remote, key); err != nil {
+				return err
+			}
+
+			return vm.recordHostKey(hostname, remote, key)
+		}, nil
+	}
+
+	if record {
+		return vm.recordHostKey, nil
+	}
+
+	pinnedHostKeyBytes, err := os.ReadFile(vm.hostKeyPath())
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read the host key pinned in \"prepare\" stage: %v",
+			ErrHostKeyMismatch, err)
+	}
+
+	pinnedHostKey, _, _, _, err := ssh.ParseAuthorizedKey(pinnedHostKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to parse the host key pinned in \"prepare\" stage: %v",
+			ErrHostKeyMismatch, err)
+	}
+
+	return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		if !bytes.Equal(key.Marshal(), pinnedHostKey.Marshal()) {
+			return fmt.Errorf("%w: expected %s, got %s", ErrHostKeyMismatch,
+				ssh.FingerprintSHA256(pinnedHostKey), ssh.FingerprintSHA256(key))
+		}
+
+		return nil
+	}, nil
+}
+
+func (vm *VM) recordHostKey(_ string, _ net.Addr, key ssh.PublicKey) error {
+	return os.WriteFile(vm.hostKeyPath(), ssh.MarshalAuthorizedKey(key), 0600)
+}
+
+func (vm *VM) hostKeyPath() string {
+	// Store the host key next to the "tart run" output,
+	// see TartRunOutputPath() for more details
+	return filepath.Join(os.TempDir(), fmt.Sprintf("%s-host-key.pub", vm.id))
+}
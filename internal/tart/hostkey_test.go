@@ -0,0 +1,71 @@
+package tart_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/gitlab"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestHostKeyTrustOnFirstUse(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	vm := tart.ExistingVM(tart.NewFakeBackend(), gitlab.Env{JobID: "42"})
+	addr := &net.TCPAddr{IP: net.IPv4(192, 168, 64, 2), Port: 22}
+
+	// Nothing is pinned yet
+	_, err := vm.HostKeyCallback(nil, false)
+	require.ErrorIs(t, err, tart.ErrHostKeyMismatch)
+
+	hostKey := generatePublicKey(t)
+
+	recordCallback, err := vm.HostKeyCallback(nil, true)
+	require.NoError(t, err)
+	require.NoError(t, recordCallback("192.168.64.2:22", addr, hostKey))
+
+	verifyCallback, err := vm.HostKeyCallback(nil, false)
+	require.NoError(t, err)
+	require.NoError(t, verifyCallback("192.168.64.2:22", addr, hostKey))
+	require.ErrorIs(t, verifyCallback("192.168.64.2:22", addr, generatePublicKey(t)),
+		tart.ErrHostKeyMismatch)
+}
+
+func TestHostKeyKnownHostsArePinned(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	vm := tart.ExistingVM(tart.NewFakeBackend(), gitlab.Env{JobID: "42"})
+	addr := &net.TCPAddr{IP: net.IPv4(192, 168, 64, 2), Port: 22}
+	hostKey := generatePublicKey(t)
+
+	knownHostsPath := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(t, os.WriteFile(knownHostsPath,
+		[]byte(knownhosts.Line([]string{"192.168.64.2"}, hostKey)+"\n"), 0600))
+
+	recordCallback, err := vm.HostKeyCallback([]string{knownHostsPath}, true)
+	require.NoError(t, err)
+	require.Error(t, recordCallback("192.168.64.2:22", addr, generatePublicKey(t)))
+	require.NoError(t, recordCallback("192.168.64.2:22", addr, hostKey))
+
+	// The "run" stage can connect without the known_hosts files
+	verifyCallback, err := vm.HostKeyCallback(nil, false)
+	require.NoError(t, err)
+	require.NoError(t, verifyCallback("192.168.64.2:22", addr, hostKey))
+}
+
+func generatePublicKey(t *testing.T) ssh.PublicKey {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	require.NoError(t, err)
+
+	return sshPublicKey
+}
@@ -0,0 +1,75 @@
+package tart
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/filelock"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+)
+
+// ImageLock protects the image from being deleted while
+// it's pulled or used by the jobs on this host.
+type ImageLock struct {
+	locks []*filelock.FileLock
+}
+
+// UseImage marks the image as used by the job until the lock is released,
+// so that it's not evicted (see diskspace) between being pulled and cloned.
+// Multiple jobs can use the same image at once.
+func UseImage(image string) (*ImageLock, error) {
+	path, err := imageLockPath(image, ".use")
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := filelock.RLock(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageLock{locks: []*filelock.FileLock{lock}}, nil
+}
+
+// TryLockImage exclusively locks the image for deletion, returning nil
+// if the image is currently being pulled or used by another job.
+//
+//nolint:nilnil // the image being busy is not an error
+func TryLockImage(image string) (*ImageLock, error) {
+	result := &ImageLock{}
+
+	// Same lock as in PullIfNeeded()
+	for _, suffix := range []string{".lock", ".use"} {
+		path, err := imageLockPath(image, suffix)
+		if err != nil {
+			result.Unlock()
+
+			return nil, err
+		}
+
+		lock, err := filelock.TryLock(path)
+		if err != nil || lock == nil {
+			result.Unlock()
+
+			return nil, err
+		}
+
+		result.locks = append(result.locks, lock)
+	}
+
+	return result, nil
+}
+
+func (imageLock *ImageLock) Unlock() {
+	for _, lock := range imageLock.locks {
+		_ = lock.Unlock()
+	}
+
+	imageLock.locks = nil
+}
+
+func imageLockPath(image string, suffix string) (string, error) {
+	hash := sha256.Sum256([]byte(image))
+
+	return statedir.Path("pulls", hex.EncodeToString(hash[:])+suffix)
+}
@@ -0,0 +1,91 @@
+package tart
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/configfile"
+)
+
+var ErrPolicyViolation = errors.New("job variable is not allowed by the policy")
+
+// operatorOnlyVariables grant access to the host's resources (files and the SSH agent),
+// so the jobs can't set them unless the policy explicitly allows it, and the operators
+// are expected to set them using the configuration file's defaults instead.
+var operatorOnlyVariables = map[string]struct{}{
+	envPrefixTartExecutor + "SSH_PRIVATE_KEY_FILE": {},
+	envPrefixTartExecutor + "SSH_AGENT":            {},
+}
+
+// applyPolicy makes sure that the TART_EXECUTOR_* variables set
+// by the job are allowed by the operator's policy, and sets the
+// forced values in the environment.
+func applyPolicy(policy *configfile.Policy, environment map[string]string) error {
+	if policy == nil {
+		policy = &configfile.Policy{}
+	}
+
+	for _, keyAndValue := range os.Environ() {
+		key, value, _ := strings.Cut(keyAndValue, "=")
+
+		name, ok := strings.CutPrefix(key, envPrefixGitLabRunner)
+		if !ok || !strings.HasPrefix(name, envPrefixTartExecutor) {
+			continue
+		}
+
+		if err := checkPolicy(policy, name, value); err != nil {
+			return err
+		}
+	}
+
+	for name, rule := range policy.Variables {
+		if rule.Force != nil {
+			environment[envPrefixGitLabRunner+name] = *rule.Force
+		}
+	}
+
+	return nil
+}
+
+func checkPolicy(policy *configfile.Policy, name string, value string) error {
+	rule, ok := policy.Variables[name]
+	if !ok {
+		if _, operatorOnly := operatorOnlyVariables[name]; operatorOnly {
+			return fmt.Errorf("%w: %s can only be set by the operator", ErrPolicyViolation, name)
+		}
+
+		if policy.Default == configfile.PolicyDeny {
+			return fmt.Errorf("%w: %s can't be set by the job", ErrPolicyViolation, name)
+		}
+
+		return nil
+	}
+
+	if !rule.Allow {
+		return fmt.Errorf("%w: %s can't be set by the job", ErrPolicyViolation, name)
+	}
+
+	if rule.Force != nil && value != *rule.Force {
+		return fmt.Errorf("%w: %s can only be set to %q", ErrPolicyViolation, name, *rule.Force)
+	}
+
+	if len(rule.Values) == 0 {
+		return nil
+	}
+
+	for _, pattern := range rule.Values {
+		match, err := doublestar.Match(pattern, value)
+		if err != nil {
+			return err
+		}
+
+		if match {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s can't be set to %q", ErrPolicyViolation, name, value)
+}
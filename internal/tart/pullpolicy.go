@@ -0,0 +1,273 @@
+package tart
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/eventlog"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/filelock"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+)
+
+var (
+	ErrInvalidPullPolicy = errors.New("invalid pull policy")
+	ErrImageNotPresent   = errors.New("image is not present locally")
+)
+
+const (
+	PullPolicyAlways       = "always"
+	PullPolicyIfNotPresent = "if-not-present"
+	PullPolicyNever        = "never"
+	PullPolicyIfOlderThan  = "if-older-than"
+)
+
+type PullPolicy struct {
+	Mode string
+
+	// MaxAge is only used with PullPolicyIfOlderThan
+	MaxAge time.Duration
+}
+
+// ParsePullPolicy parses "always", "if-not-present", "never"
+// and "if-older-than=<duration>" (e.g. "if-older-than=24h").
+func ParsePullPolicy(value string) (PullPolicy, error) {
+	mode, rawMaxAge, hasMaxAge := strings.Cut(value, "=")
+
+	switch mode {
+	case PullPolicyAlways, PullPolicyIfNotPresent, PullPolicyNever:
+		if hasMaxAge {
+			return PullPolicy{}, fmt.Errorf("%w %q: %q doesn't take a value", ErrInvalidPullPolicy, value, mode)
+		}
+
+		return PullPolicy{Mode: mode}, nil
+	case PullPolicyIfOlderThan:
+		maxAge, err := time.ParseDuration(rawMaxAge)
+		if err != nil {
+			return PullPolicy{}, fmt.Errorf("%w %q: %v", ErrInvalidPullPolicy, value, err)
+		}
+
+		return PullPolicy{Mode: mode, MaxAge: maxAge}, nil
+	default:
+		return PullPolicy{}, fmt.Errorf("%w %q: expected %q, %q, %q or \"%s=<duration>\"",
+			ErrInvalidPullPolicy, value, PullPolicyAlways, PullPolicyIfNotPresent,
+			PullPolicyNever, PullPolicyIfOlderThan)
+	}
+}
+
+// PullPolicy returns the pull policy set via TART_EXECUTOR_PULL_POLICY,
+// falling back to the TART_EXECUTOR_ALWAYS_PULL for compatibility.
+func (config Config) PullPolicy() (PullPolicy, error) {
+	if config.RawPullPolicy != "" {
+		return ParsePullPolicy(config.RawPullPolicy)
+	}
+
+	if config.AlwaysPull {
+		return PullPolicy{Mode: PullPolicyAlways}, nil
+	}
+
+	// "tart clone" will still pull the image if it doesn't exist locally
+	return PullPolicy{Mode: PullPolicyIfNotPresent}, nil
+}
+
+// NeedsPull decides whether the image needs to be pulled according to the policy.
+//
+// Digest-pinned images (e.g. "image@sha256:...") are immutable, so they're
+// never pulled again once present, which also avoids pulling the image twice
+// when it was already pulled to be resolved to a digest (see imageverify).
+func (policy PullPolicy) NeedsPull(ctx context.Context, backend Backend, image string) (bool, error) {
+	if policy.Mode == PullPolicyAlways && !strings.Contains(image, "@") {
+		return true, nil
+	}
+
+	listEntries, err := backend.List(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	var listEntry *ListEntry
+
+	for _, candidate := range listEntries {
+		if candidate.Name == image {
+			listEntry = &candidate
+
+			break
+		}
+	}
+
+	switch {
+	case listEntry == nil && policy.Mode == PullPolicyNever:
+		return false, fmt.Errorf("%w: %s (pull policy is %q)", ErrImageNotPresent, image, PullPolicyNever)
+	case listEntry == nil:
+		return true, nil
+	case strings.Contains(image, "@"):
+		return false, nil
+	case policy.Mode == PullPolicyIfOlderThan:
+		return time.Since(pulledAt(image, *listEntry)) > policy.MaxAge, nil
+	default:
+		return false, nil
+	}
+}
+
+// PullIfNeeded pulls the image if the policy requires that.
+func PullIfNeeded(
+	ctx context.Context,
+	backend Backend,
+	env map[string]string,
+	image string,
+	policy PullPolicy,
+	opts PullOptions,
+) error {
+	// Concurrent jobs on the same host that use the same image
+	// wait for each other instead of pulling it simultaneously
+	lock, waitedSince, err := lockPull(image)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if !waitedSince.IsZero() {
+		if pulls, err := readPulls(); err == nil && pulls[image].After(waitedSince) {
+			log.Printf("Using %s that was just pulled by another job\n", image)
+
+			return nil
+		}
+	}
+
+	needsPull, err := policy.NeedsPull(ctx, backend, image)
+	if err != nil {
+		return err
+	}
+
+	if !needsPull {
+		log.Printf("Not pulling %s since it's present locally (pull policy is %q)\n", image, policy.Mode)
+
+		return nil
+	}
+
+	log.Printf("Pulling the latest version of %s...\n", image)
+
+	step := eventlog.Begin("pull", "")
+	err = retryTart(ctx, "pull "+image, opts, func() error {
+		return backend.Pull(ctx, env, image, opts)
+	})
+	step.End(err)
+	if err != nil {
+		return err
+	}
+
+	if err := recordPull(image); err != nil {
+		log.Printf("Failed to record the pull time of %s: %v\n", image, err)
+	}
+
+	return nil
+}
+
+// lockPull acquires a host-level lock for pulling the image and
+// returns the time at which the waiting started, if it had to wait.
+func lockPull(image string) (*filelock.FileLock, time.Time, error) {
+	path, err := imageLockPath(image, ".lock")
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	lock, err := filelock.TryLock(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if lock != nil {
+		return lock, time.Time{}, nil
+	}
+
+	waitedSince := time.Now()
+
+	log.Printf("Waiting for another job on this host to finish pulling %s...\n", image)
+
+	lock, err = filelock.Lock(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return lock, waitedSince, nil
+}
+
+// pulledAt returns the time at which the image was last pulled by us,
+// falling back to the time at which it was last accessed according to
+// Tart for the images pulled by other means.
+func pulledAt(image string, listEntry ListEntry) time.Time {
+	pulls, err := readPulls()
+	if err == nil {
+		if result, ok := pulls[image]; ok {
+			return result
+		}
+	}
+
+	result, err := listEntry.AccessedAt()
+	if err != nil {
+		// Assume that the image is stale
+		return time.Time{}
+	}
+
+	return result
+}
+
+func recordPull(image string) error {
+	path, err := statedir.Path("pulls.json")
+	if err != nil {
+		return err
+	}
+
+	lock, err := filelock.Lock(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	pulls, err := readPulls()
+	if err != nil {
+		return err
+	}
+
+	pulls[image] = time.Now()
+
+	pullsBytes, err := json.Marshal(pulls)
+	if err != nil {
+		return err
+	}
+
+	// Readers don't take the lock, so make sure they never see a partially written file
+	if err := os.WriteFile(path+".tmp", pullsBytes, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func readPulls() (map[string]time.Time, error) {
+	path, err := statedir.Path("pulls.json")
+	if err != nil {
+		return nil, err
+	}
+
+	pulls := map[string]time.Time{}
+
+	pullsBytes, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return pulls, nil
+		}
+
+		return nil, err
+	}
+
+	if err := json.Unmarshal(pullsBytes, &pulls); err != nil {
+		return nil, err
+	}
+
+	return pulls, nil
+}
@@ -0,0 +1,142 @@
+package tart_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePullPolicy(t *testing.T) {
+	pullPolicy, err := tart.ParsePullPolicy("if-not-present")
+	require.NoError(t, err)
+	require.Equal(t, tart.PullPolicy{Mode: tart.PullPolicyIfNotPresent}, pullPolicy)
+
+	pullPolicy, err = tart.ParsePullPolicy("if-older-than=24h")
+	require.NoError(t, err)
+	require.Equal(t, tart.PullPolicy{Mode: tart.PullPolicyIfOlderThan, MaxAge: 24 * time.Hour}, pullPolicy)
+
+	for _, invalid := range []string{"sometimes", "never=1h", "if-older-than", "if-older-than=yesterday"} {
+		_, err = tart.ParsePullPolicy(invalid)
+		require.ErrorIs(t, err, tart.ErrInvalidPullPolicy, invalid)
+	}
+}
+
+func TestNeedsPull(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+
+	const image = "ghcr.io/cirruslabs/macos-sonoma-base:latest"
+
+	needsPull := func(rawPullPolicy string) (bool, error) {
+		pullPolicy, err := tart.ParsePullPolicy(rawPullPolicy)
+		require.NoError(t, err)
+
+		return pullPolicy.NeedsPull(ctx, backend, image)
+	}
+
+	// Image is not present
+	for rawPullPolicy, expected := range map[string]bool{
+		"always":            true,
+		"if-not-present":    true,
+		"if-older-than=24h": true,
+	} {
+		result, err := needsPull(rawPullPolicy)
+		require.NoError(t, err)
+		require.Equal(t, expected, result, rawPullPolicy)
+	}
+
+	_, err := needsPull("never")
+	require.ErrorIs(t, err, tart.ErrImageNotPresent)
+
+	require.NoError(t, tart.PullIfNeeded(ctx, backend, nil, image,
+		tart.PullPolicy{Mode: tart.PullPolicyAlways}, tart.PullOptions{}))
+
+	// Image was just pulled
+	for rawPullPolicy, expected := range map[string]bool{
+		"always":            true,
+		"if-not-present":    false,
+		"never":             false,
+		"if-older-than=24h": false,
+		"if-older-than=0s":  true,
+	} {
+		result, err := needsPull(rawPullPolicy)
+		require.NoError(t, err)
+		require.Equal(t, expected, result, rawPullPolicy)
+	}
+
+	// Digest-pinned images are immutable, so they're not pulled again
+	// even with "always" (e.g. after imageverify resolved the image)
+	pinnedImage, err := backend.FQN(ctx, image)
+	require.NoError(t, err)
+
+	needsPullPinned, err := tart.PullPolicy{Mode: tart.PullPolicyAlways}.NeedsPull(ctx, backend, pinnedImage)
+	require.NoError(t, err)
+	require.False(t, needsPullPinned)
+
+	needsPullPinned, err = tart.PullPolicy{Mode: tart.PullPolicyAlways}.NeedsPull(ctx, backend,
+		"ghcr.io/cirruslabs/macos-sonoma-base@sha256:1")
+	require.NoError(t, err)
+	require.True(t, needsPullPinned)
+}
+
+type blockingPullBackend struct {
+	*tart.FakeBackend
+
+	pulls   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (backend *blockingPullBackend) Pull(
+	ctx context.Context,
+	env map[string]string,
+	image string,
+	opts tart.PullOptions,
+) error {
+	if backend.pulls.Add(1) == 1 {
+		close(backend.started)
+	}
+
+	<-backend.release
+
+	return backend.FakeBackend.Pull(ctx, env, image, opts)
+}
+
+func TestPullIfNeededDeduplication(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	ctx := context.Background()
+	backend := &blockingPullBackend{
+		FakeBackend: tart.NewFakeBackend(),
+		started:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+
+	const image = "ghcr.io/cirruslabs/macos-sonoma-base:latest"
+
+	errs := make(chan error, 2)
+
+	pull := func() {
+		errs <- tart.PullIfNeeded(ctx, backend, nil, image,
+			tart.PullPolicy{Mode: tart.PullPolicyAlways}, tart.PullOptions{})
+	}
+
+	go pull()
+	<-backend.started
+
+	// The second pull waits for the first one and reuses its result
+	go pull()
+	time.Sleep(100 * time.Millisecond)
+	close(backend.release)
+
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	require.EqualValues(t, 1, backend.pulls.Load())
+}
@@ -0,0 +1,75 @@
+package tart
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+)
+
+const maxPullRetryDelay = time.Minute
+
+var (
+	// Name resolution and routing issues, which are checked before the fatal
+	// errors since some of them look similar (e.g. "host not found")
+	hostTartErrorPattern = regexp.MustCompile(`(?i)host not found|hostname could not be found|` +
+		`could not resolve|no such host|no route to host`)
+
+	// Errors that won't go away no matter how many times we retry
+	fatalTartErrorPattern = regexp.MustCompile(`(?i)not found|does not exist|unauthorized|authenticat|` +
+		`forbidden|denied|\b40[134]\b|invalid reference|already exists|no space left`)
+
+	// Network issues and registry-side errors
+	retryableTartErrorPattern = regexp.MustCompile(`(?i)\b5\d\d\b|internal server error|bad gateway|` +
+		`service unavailable|gateway timeout|too many requests|\b429\b|timed out|timeout|connection|` +
+		`network|reset by peer|broken pipe|unexpected EOF|temporarily|TLS handshake`)
+)
+
+// IsRetryable classifies the Tart failures based on their output, so that
+// only the transient ones (network issues and 5xx registry responses)
+// are retried, while the rest (e.g. missing image or bad credentials)
+// fail right away.
+func IsRetryable(err error) bool {
+	if !errors.Is(err, ErrTartFailed) {
+		return false
+	}
+
+	message := err.Error()
+
+	if hostTartErrorPattern.MatchString(message) {
+		return true
+	}
+
+	if fatalTartErrorPattern.MatchString(message) {
+		return false
+	}
+
+	return retryableTartErrorPattern.MatchString(message)
+}
+
+// retryTart invokes the Tart operation, retrying the transient failures
+// with an exponential backoff according to the pull options.
+func retryTart(ctx context.Context, what string, opts PullOptions, operation func() error) error {
+	return retry.Do(operation,
+		retry.Context(ctx),
+		retry.Attempts(opts.Retries+1),
+		retry.Delay(opts.RetryDelay),
+		retry.MaxDelay(maxPullRetryDelay),
+		retry.DelayType(retry.BackOffDelay),
+		retry.LastErrorOnly(true),
+		retry.RetryIf(IsRetryable),
+		retry.OnRetry(func(attempt uint, err error) {
+			// Also called after the last attempt
+			if attempt >= opts.Retries {
+				return
+			}
+
+			log.Printf("Failed to %s (attempt %d of %d), retrying: %s\n", what, attempt+1,
+				opts.Retries+1, strings.TrimPrefix(err.Error(), ErrTartFailed.Error()+": "))
+		}),
+	)
+}
@@ -0,0 +1,85 @@
+package tart_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/statedir"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRetryable(t *testing.T) {
+	for message, expected := range map[string]bool{
+		"Error: connection reset by peer":                                 true,
+		"Error: The request timed out.":                                   true,
+		"Error: HTTP 503 Service Unavailable":                             true,
+		"Error: unexpected HTTP status code 502":                          true,
+		"Error: repository ghcr.io/cirruslabs/missing not found":          false,
+		"Error: HTTP 401 Unauthorized, invalid credentials":               false,
+		"Error: connection denied: insufficient scope for resource":       false,
+		"Error: invalid disk format":                                      false,
+		"Error: host not found: ghcr.io":                                  true,
+		"Error: A server with the specified hostname could not be found.": true,
+		"Error: dial tcp: lookup ghcr.io: no such host":                   true,
+	} {
+		require.Equal(t, expected, tart.IsRetryable(fmt.Errorf("%w: %q", tart.ErrTartFailed, message)), message)
+	}
+
+	require.False(t, tart.IsRetryable(context.DeadlineExceeded))
+}
+
+type flakyPullBackend struct {
+	*tart.FakeBackend
+
+	failures []error
+	pulls    int
+}
+
+func (backend *flakyPullBackend) Pull(
+	ctx context.Context,
+	env map[string]string,
+	image string,
+	opts tart.PullOptions,
+) error {
+	backend.pulls++
+
+	if len(backend.failures) != 0 {
+		err := backend.failures[0]
+		backend.failures = backend.failures[1:]
+
+		return err
+	}
+
+	return backend.FakeBackend.Pull(ctx, env, image, opts)
+}
+
+func TestPullIfNeededRetries(t *testing.T) {
+	t.Cleanup(statedir.Override(t.TempDir()))
+
+	ctx := context.Background()
+	pullPolicy := tart.PullPolicy{Mode: tart.PullPolicyAlways}
+	pullOpts := tart.PullOptions{Retries: 2}
+
+	const image = "ghcr.io/cirruslabs/macos-sonoma-base:latest"
+
+	transient := fmt.Errorf("%w: %q", tart.ErrTartFailed, "Error: HTTP 503 Service Unavailable")
+	fatal := fmt.Errorf("%w: %q", tart.ErrTartFailed, "Error: HTTP 401 Unauthorized")
+
+	// Transient failures are retried
+	backend := &flakyPullBackend{FakeBackend: tart.NewFakeBackend(), failures: []error{transient, transient}}
+	require.NoError(t, tart.PullIfNeeded(ctx, backend, nil, image, pullPolicy, pullOpts))
+	require.Equal(t, 3, backend.pulls)
+
+	// ...but only up to the configured number of retries
+	backend = &flakyPullBackend{FakeBackend: tart.NewFakeBackend(),
+		failures: []error{transient, transient, transient}}
+	require.ErrorIs(t, tart.PullIfNeeded(ctx, backend, nil, image, pullPolicy, pullOpts), tart.ErrTartFailed)
+	require.Equal(t, 3, backend.pulls)
+
+	// Fatal failures are not retried
+	backend = &flakyPullBackend{FakeBackend: tart.NewFakeBackend(), failures: []error{fatal}}
+	require.ErrorIs(t, tart.PullIfNeeded(ctx, backend, nil, image, pullPolicy, pullOpts), tart.ErrTartFailed)
+	require.Equal(t, 1, backend.pulls)
+}
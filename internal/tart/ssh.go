@@ -0,0 +1,92 @@
+package tart
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var ErrSSHAuth = errors.New("failed to configure SSH authentication")
+
+// sshAuthMethods returns the SSH authentication methods to use
+// when connecting to the VM, in the order of preference.
+//
+// Public key methods (private key, private key file and SSH agent)
+// come first, and the password method is only used either when
+// no public key methods are configured or when the password was
+// set explicitly.
+//
+// The returned io.Closer should be closed once the SSH handshake
+// is complete, regardless of its outcome.
+func (config Config) sshAuthMethods() ([]ssh.AuthMethod, io.Closer, error) {
+	var authMethods []ssh.AuthMethod
+	var signers []ssh.Signer
+
+	if config.SSHPrivateKey != "" {
+		signer, err := config.parsePrivateKey([]byte(config.SSHPrivateKey))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: failed to parse TART_EXECUTOR_SSH_PRIVATE_KEY: %v",
+				ErrSSHAuth, err)
+		}
+
+		signers = append(signers, signer)
+	}
+
+	if config.SSHPrivateKeyFile != "" {
+		privateKeyBytes, err := os.ReadFile(config.SSHPrivateKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: failed to read TART_EXECUTOR_SSH_PRIVATE_KEY_FILE: %v",
+				ErrSSHAuth, err)
+		}
+
+		signer, err := config.parsePrivateKey(privateKeyBytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: failed to parse TART_EXECUTOR_SSH_PRIVATE_KEY_FILE: %v",
+				ErrSSHAuth, err)
+		}
+
+		signers = append(signers, signer)
+	}
+
+	if len(signers) != 0 {
+		authMethods = append(authMethods, ssh.PublicKeys(signers...))
+	}
+
+	var closer io.Closer = io.NopCloser(nil)
+
+	if config.SSHAgent {
+		socketPath, ok := os.LookupEnv("SSH_AUTH_SOCK")
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: TART_EXECUTOR_SSH_AGENT is enabled, but SSH_AUTH_SOCK "+
+				"is not set in the executor's environment", ErrSSHAuth)
+		}
+
+		//nolint:noctx // the connection is local and short-lived
+		agentConn, err := net.Dial("unix", socketPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: failed to connect to the SSH agent: %v", ErrSSHAuth, err)
+		}
+
+		authMethods = append(authMethods, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+		closer = agentConn
+	}
+
+	if len(authMethods) == 0 || config.sshPasswordSet {
+		authMethods = append(authMethods, ssh.Password(config.SSHPassword))
+	}
+
+	return authMethods, closer, nil
+}
+
+func (config Config) parsePrivateKey(privateKeyBytes []byte) (ssh.Signer, error) {
+	if config.SSHPrivateKeyPassphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(privateKeyBytes, []byte(config.SSHPrivateKeyPassphrase))
+	}
+
+	return ssh.ParsePrivateKey(privateKeyBytes)
+}
@@ -1,16 +1,14 @@
 package tart
 
 import (
-	"bytes"
+	"cmp"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net"
+	"math"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -19,37 +17,76 @@ import (
 
 	"github.com/avast/retry-go/v4"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/dialer"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/eventlog"
 	"github.com/cirruslabs/gitlab-tart-executor/internal/gitlab"
 	"golang.org/x/crypto/ssh"
-)
-
-const (
-	TartCommandName         = "tart"
-	TartCommandHomebrewPath = "/opt/homebrew/bin/tart"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var (
 	ErrTartNotFound = errors.New("tart command not found")
 	ErrTartFailed   = errors.New("tart command returned non-zero exit code")
 	ErrVMFailed     = errors.New("VM errored")
+	ErrBootTimeout  = errors.New("VM failed to boot in time")
+	ErrVMExited     = errors.New("VM exited prematurely")
+)
+
+const (
+	bootErrorOutputLines = 20
+	tartRunWatchInterval = 500 * time.Millisecond
 )
 
 type VM struct {
-	id string
+	id      string
+	backend Backend
 }
 
-type VMInfo struct {
-	OS string `json:"os"`
+func ExistingVM(backend Backend, gitLabEnv gitlab.Env) *VM {
+	return &VM{
+		id:      gitLabEnv.VirtualMachineID(),
+		backend: backend,
+	}
 }
 
-func ExistingVM(gitLabEnv gitlab.Env) *VM {
+func ExistingVMByName(backend Backend, name string) *VM {
 	return &VM{
-		id: gitLabEnv.VirtualMachineID(),
+		id:      name,
+		backend: backend,
+	}
+}
+
+// AdoptVM takes over an already running VM (for example, the one from
+// the warm pool) by renaming it and carrying over its "tart run" output.
+func AdoptVM(
+	ctx context.Context,
+	backend Backend,
+	name string,
+	outputPath string,
+	pidPath string,
+	newName string,
+) (*VM, error) {
+	vm := ExistingVMByName(backend, name)
+
+	if err := vm.Rename(ctx, newName); err != nil {
+		return nil, err
+	}
+
+	if err := os.Symlink(outputPath, vm.TartRunOutputPath()); err != nil {
+		return nil, err
 	}
+
+	if pidPath != "" {
+		if err := os.Symlink(pidPath, vm.TartRunPIDPath()); err != nil {
+			return nil, err
+		}
+	}
+
+	return vm, nil
 }
 
 func CreateNewVM(
 	ctx context.Context,
+	backend Backend,
 	name string,
 	image string,
 	config Config,
@@ -58,7 +95,8 @@ func CreateNewVM(
 	additionalCloneAndPullEnv map[string]string,
 ) (*VM, error) {
 	vm := &VM{
-		id: name,
+		id:      name,
+		backend: backend,
 	}
 
 	if err := vm.cloneAndConfigure(ctx, image, config, cpuOverride, memoryOverride,
@@ -69,6 +107,10 @@ func CreateNewVM(
 	return vm, nil
 }
 
+func (vm *VM) Name() string {
+	return vm.id
+}
+
 //nolint:funcorder // let's fix this later
 func (vm *VM) cloneAndConfigure(
 	ctx context.Context,
@@ -80,56 +122,68 @@ func (vm *VM) cloneAndConfigure(
 ) error {
 	log.Println("Cloning a new VM...")
 
-	cloneArgs := []string{"clone", image, vm.id}
-
-	if config.InsecurePull {
-		cloneArgs = append(cloneArgs, "--insecure")
-	}
-
-	if config.PullConcurrency != 0 {
-		cloneArgs = append(cloneArgs, "--concurrency",
-			strconv.FormatUint(uint64(config.PullConcurrency), 10))
-	}
-
-	_, _, err := TartExecWithEnv(ctx, additionalCloneAndPullEnv, cloneArgs...)
+	step := eventlog.Begin("clone", vm.id)
+	pullOpts := config.PullOptions()
+	err := retryTart(ctx, "clone "+image, pullOpts, func() error {
+		return vm.backend.Clone(ctx, additionalCloneAndPullEnv, image, vm.id, pullOpts)
+	})
+	step.End(err)
 	if err != nil {
 		return err
 	}
 
 	log.Println("Configuring a new VM...")
 
-	if cpuOverride != 0 {
-		_, _, err = TartExec(ctx, "set", "--cpu", strconv.FormatUint(cpuOverride, 10), vm.id)
-		if err != nil {
-			return err
-		}
-	}
+	return vm.Configure(ctx, config, cpuOverride, memoryOverride)
+}
 
-	if memoryOverride != 0 {
-		_, _, err = TartExec(ctx, "set", "--memory", strconv.FormatUint(memoryOverride, 10), vm.id)
+// Configure applies the settings that can only be changed while the VM is stopped.
+func (vm *VM) Configure(ctx context.Context, config Config, cpuOverride uint64, memoryOverride uint64) error {
+	diskSize := config.DiskSize
+
+	// "tart set --disk-size" can only grow the disk, so keep
+	// the VM's disk as is when it's already large enough
+	if diskSize != 0 {
+		vmInfo, err := vm.backend.Get(ctx, vm.id)
 		if err != nil {
 			return err
 		}
-	}
 
-	if config.RandomMAC {
-		_, _, err = TartExec(ctx, "set", "--random-mac", vm.id)
-		if err != nil {
-			return err
+		if vmInfo.Disk >= diskSize {
+			if vmInfo.Disk > diskSize {
+				log.Printf("Keeping the VM's %d GB disk since it's larger than the requested %d GB\n",
+					vmInfo.Disk, diskSize)
+			}
+
+			diskSize = 0
 		}
 	}
 
-	if config.Display != "" {
-		_, _, err = TartExec(ctx, "set", "--display", config.Display, vm.id)
-		if err != nil {
-			return err
-		}
+	step := eventlog.Begin("set", vm.id)
+	err := vm.backend.Set(ctx, vm.id, SetOptions{
+		CPU:       cpuOverride,
+		Memory:    memoryOverride,
+		DiskSize:  diskSize,
+		RandomMAC: config.RandomMAC,
+		Display:   config.Display,
+	})
+	step.End(err)
+
+	return err
+}
+
+func (vm *VM) Rename(ctx context.Context, newName string) error {
+	if err := vm.backend.Rename(ctx, vm.id, newName); err != nil {
+		return fmt.Errorf("%w: failed to rename VM %s to %s: %v", ErrVMFailed, vm.id, newName, err)
 	}
 
+	vm.id = newName
+
 	return nil
 }
 
 func (vm *VM) Start(
+	ctx context.Context,
 	config Config,
 	gitLabEnv *gitlab.Env,
 	customDirectoryMounts []string,
@@ -137,7 +191,7 @@ func (vm *VM) Start(
 	nested bool,
 	env []string,
 ) error {
-	var runArgs = []string{"run"}
+	var runArgs []string
 
 	if config.Softnet {
 		runArgs = append(runArgs, "--net-softnet")
@@ -181,44 +235,20 @@ func (vm *VM) Start(
 			cacheDir, gitLabEnv.JobID))
 	}
 
-	runArgs = append(runArgs, vm.id)
+	step := eventlog.Begin("start", vm.id)
+	err := vm.backend.Run(ctx, vm.id, RunOptions{
+		Args:       runArgs,
+		Env:        env,
+		OutputPath: vm.TartRunOutputPath(),
+		PIDPath:    vm.TartRunPIDPath(),
+	})
+	step.End(err)
 
-	tartCommandPath, err := tartCommandPath()
-	if err != nil {
-		return err
-	}
-
-	//nolint:gosec,noctx // it's OK to launch a subrocess with variable, plus we can't use context.Context here
-	cmd := exec.Command(tartCommandPath, runArgs...)
-
-	// Base environment
-	cmd.Env = cmd.Environ()
-
-	// Environment overrides
-	cmd.Env = append(cmd.Env, env...)
-
-	outputFile, err := os.OpenFile(vm.tartRunOutputPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
-	if err != nil {
-		return err
-	}
-
-	cmd.Stdout = outputFile
-	cmd.Stderr = outputFile
-
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setsid: true,
-	}
-
-	err = cmd.Start()
-	if err != nil {
-		return err
-	}
-
-	return cmd.Process.Release()
+	return err
 }
 
 func (vm *VM) MonitorTartRunOutput() {
-	outputFile, err := os.Open(vm.tartRunOutputPath())
+	outputFile, err := os.Open(vm.TartRunOutputPath())
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to open VM's output file, "+
 			"looks like the VM wasn't started in \"prepare\" step?\n")
@@ -244,39 +274,67 @@ func (vm *VM) MonitorTartRunOutput() {
 	}
 }
 
-func (vm *VM) OpenSSH(ctx context.Context, config Config, dialer dialer.Dialer) (*ssh.Client, error) {
+func (vm *VM) OpenSSH(
+	ctx context.Context,
+	config Config,
+	dialer dialer.Dialer,
+	hostKeyCallback ssh.HostKeyCallback,
+) (*ssh.Client, error) {
 	var ip string
 	var err error
 
+	bootTimeout := cmp.Or(config.BootTimeout, DefaultBootTimeout)
+	retryDelay := cmp.Or(config.SSHRetryDelay, DefaultSSHRetryDelay)
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, bootTimeout)
+	defer timeoutCancel()
+
+	// Stop waiting as soon as the VM is gone
+	bootCtx, bootCancel := context.WithCancelCause(timeoutCtx)
+	defer bootCancel(nil)
+
+	go vm.watchTartRun(bootCtx, bootCancel)
+
+	step := eventlog.Begin("ip", vm.id)
 	if err := retry.Do(func() error {
-		ip, err = vm.IP(ctx, config)
+		ip, err = vm.IP(bootCtx, config)
 		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "Failed to retrieve IP address of VM %q in 60 seconds: %v, "+
-				"will re-try...", vm.id, err)
+			_, _ = fmt.Fprintf(os.Stderr, "Failed to retrieve IP address of VM %q in %s: %v, "+
+				"will re-try...", vm.id, cmp.Or(config.IPTimeout, DefaultIPTimeout), err)
 
 			return err
 		}
 
 		return nil
-	}, retry.Context(ctx), retry.DelayType(retry.FixedDelay), retry.Delay(time.Second)); err != nil {
+	}, retry.Context(bootCtx), retry.Attempts(0), retry.Delay(retryDelay),
+		retry.DelayType(retry.FixedDelay)); err != nil {
+		err = vm.bootError(ctx, bootCtx, bootTimeout, err)
+		step.End(err)
+
 		return nil, err
 	}
+	step.End(nil)
 
 	addr := fmt.Sprintf("%s:%d", ip, config.SSHPort)
 
+	authMethods, authCloser, err := config.sshAuthMethods()
+	if err != nil {
+		return nil, err
+	}
+	defer authCloser.Close()
+
 	sshConfig := &ssh.ClientConfig{
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			return nil
-		},
-		User: config.SSHUsername,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(config.SSHPassword),
-		},
+		HostKeyCallback: hostKeyCallback,
+		User:            config.SSHUsername,
+		Auth:            authMethods,
 	}
 
 	var sshClient *ssh.Client
 
+	step = eventlog.Begin("ssh", vm.id)
 	if err := retry.Do(func() error {
+		// Note that we're intentionally not using the bootCtx here
+		// as the connection outlives the OpenSSH() invocation
 		netConn, err := dialer.DialContext(ctx, "tcp", addr)
 		if err != nil {
 			return err
@@ -284,122 +342,139 @@ func (vm *VM) OpenSSH(ctx context.Context, config Config, dialer dialer.Dialer)
 
 		sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, sshConfig)
 		if err != nil {
+			// No point in re-trying when talking to a different machine
+			var keyError *knownhosts.KeyError
+
+			if errors.Is(err, ErrHostKeyMismatch) || errors.As(err, &keyError) {
+				return retry.Unrecoverable(err)
+			}
+
 			return err
 		}
 
 		sshClient = ssh.NewClient(sshConn, chans, reqs)
 		return nil
-	}, retry.Context(ctx), retry.Attempts(0), retry.Delay(time.Second),
+	}, retry.Context(bootCtx), retry.Attempts(0), retry.Delay(retryDelay),
 		retry.DelayType(retry.FixedDelay)); err != nil {
-		return nil, fmt.Errorf("%w: failed to connect via SSH: %v", ErrVMFailed, err)
+		err = vm.bootError(ctx, bootCtx, bootTimeout, fmt.Errorf("%w: failed to connect via SSH: %v",
+			ErrVMFailed, err))
+		step.End(err)
+
+		return nil, err
 	}
+	step.End(nil)
 
 	return sshClient, nil
 }
 
-func (vm *VM) IP(ctx context.Context, config Config) (string, error) {
-	resolver := "dhcp"
-	if config.Bridged != "" {
-		resolver = "arp"
-	}
-	stdout, _, err := TartExec(ctx, "ip", "--wait", "60", "--resolver", resolver, vm.id)
-	if err != nil {
-		return "", err
+// bootError explains why the VM didn't become SSH-able when it's
+// due to the boot timeout, which is most likely caused by the VM
+// failing to boot, so the "tart run" output is the most helpful.
+func (vm *VM) bootError(ctx context.Context, bootCtx context.Context, bootTimeout time.Duration, err error) error {
+	if ctx.Err() != nil {
+		return err
 	}
 
-	return strings.TrimSpace(stdout), nil
-}
-
-func (vm *VM) Info(ctx context.Context) (*VMInfo, error) {
-	stdout, _, err := TartExec(ctx, "get", "--format", "json", vm.id)
-	if err != nil {
-		return nil, err
+	if errors.Is(context.Cause(bootCtx), ErrVMExited) {
+		return fmt.Errorf("%w: \"tart run\" for VM %q is not running anymore, "+
+			"last lines of its output:\n%s", ErrVMExited, vm.id, vm.tartRunOutputTail(bootErrorOutputLines))
 	}
 
-	var vmInfo VMInfo
-
-	if err := json.Unmarshal([]byte(stdout), &vmInfo); err != nil {
-		return nil, err
+	if !errors.Is(bootCtx.Err(), context.DeadlineExceeded) {
+		return err
 	}
 
-	return &vmInfo, nil
+	return fmt.Errorf("%w: VM %q is not SSH-able after %s (%v), last lines of the \"tart run\" output:\n%s",
+		ErrBootTimeout, vm.id, bootTimeout, err, vm.tartRunOutputTail(bootErrorOutputLines))
 }
 
-func (vm *VM) Stop() error {
-	_, _, err := TartExec(context.Background(), "stop", vm.id)
+func (vm *VM) watchTartRun(ctx context.Context, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(tartRunWatchInterval)
+	defer ticker.Stop()
 
-	return err
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if vm.tartRunExited() {
+				cancel(ErrVMExited)
+
+				return
+			}
+		}
+	}
 }
 
-func (vm *VM) Delete() error {
-	_, _, err := TartExec(context.Background(), "delete", vm.id)
+// tartRunExited returns true when the process running the VM is known to be gone.
+//
+// Note that the VMs started before the PID was recorded are assumed to be running.
+func (vm *VM) tartRunExited() bool {
+	pidBytes, err := os.ReadFile(vm.TartRunPIDPath())
 	if err != nil {
-		return fmt.Errorf("%w: failed to delete VM %s: %v", ErrVMFailed, vm.id, err)
+		return false
 	}
 
-	return nil
-}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
+	if err != nil {
+		return false
+	}
 
-func TartExec(
-	ctx context.Context,
-	args ...string,
-) (string, string, error) {
-	return TartExecWithEnv(ctx, nil, args...)
+	return errors.Is(syscall.Kill(pid, 0), syscall.ESRCH)
 }
 
-func TartExecWithEnv(
-	ctx context.Context,
-	env map[string]string,
-	args ...string,
-) (string, string, error) {
-	tartCommandPath, err := tartCommandPath()
+func (vm *VM) tartRunOutputTail(lines int) string {
+	output, err := os.ReadFile(vm.TartRunOutputPath())
 	if err != nil {
-		return "", "", err
+		return fmt.Sprintf("(failed to read: %v)", err)
 	}
 
-	//nolint:gosec // it's OK to launch a subrocess with variable
-	cmd := exec.CommandContext(ctx, tartCommandPath, args...)
+	outputLines := strings.Split(strings.TrimRight(string(output), "\n"), "\n")
+	if len(outputLines) > lines {
+		outputLines = outputLines[len(outputLines)-lines:]
+	}
 
-	// Base environment
-	cmd.Env = cmd.Environ()
+	return strings.Join(outputLines, "\n")
+}
 
-	// Environment overrides
-	for key, value := range env {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+func (vm *VM) IP(ctx context.Context, config Config) (string, error) {
+	resolver := "dhcp"
+	if config.Bridged != "" {
+		resolver = "arp"
 	}
 
-	var stdout, stderr bytes.Buffer
+	ipTimeout := cmp.Or(config.IPTimeout, DefaultIPTimeout)
 
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	return vm.backend.IP(ctx, vm.id, IPOptions{
+		Wait:     uint(math.Ceil(ipTimeout.Seconds())),
+		Resolver: resolver,
+	})
+}
 
-	err = cmd.Run()
-	if err != nil {
-		var exitError *exec.ExitError
+func (vm *VM) Info(ctx context.Context) (*VMInfo, error) {
+	return vm.backend.Get(ctx, vm.id)
+}
 
-		if errors.As(err, &exitError) {
-			// Tart command failed, redefine the error
-			// to be the Tart-specific output
-			err = fmt.Errorf("%w: %q", ErrTartFailed, firstNonEmptyLine(stderr.String(), stdout.String()))
-		}
-	}
+func (vm *VM) Stop() error {
+	step := eventlog.Begin("stop", vm.id)
+	err := vm.backend.Stop(context.Background(), vm.id)
+	step.End(err)
 
-	return stdout.String(), stderr.String(), err
+	return err
 }
 
-func firstNonEmptyLine(outputs ...string) string {
-	for _, output := range outputs {
-		for line := range strings.SplitSeq(output, "\n") {
-			if line != "" {
-				return line
-			}
-		}
+func (vm *VM) Delete() error {
+	step := eventlog.Begin("delete", vm.id)
+	err := vm.backend.Delete(context.Background(), vm.id)
+	step.End(err)
+	if err != nil {
+		return fmt.Errorf("%w: failed to delete VM %s: %v", ErrVMFailed, vm.id, err)
 	}
 
-	return ""
+	return nil
 }
 
-func (vm *VM) tartRunOutputPath() string {
+func (vm *VM) TartRunOutputPath() string {
 	// GitLab Runner redefines the TMPDIR environment variable for
 	// custom executors[1] and cleans it up (you can check that by
 	// following the "cmdOpts.Dir" xrefs, so we don't need to bother
@@ -410,22 +485,8 @@ func (vm *VM) tartRunOutputPath() string {
 	return filepath.Join(os.TempDir(), fmt.Sprintf("%s-tart-run-output.log", vm.id))
 }
 
-func tartCommandPath() (string, error) {
-	result, err := exec.LookPath(TartCommandName)
-	if err != nil {
-		// Perhaps GitLab Runner was invoked from a launchd user agent
-		// with a limited PATH[1], check if Tart is available in the
-		// Homebrew's binary directory before completely failing.
-		//
-		// [1]: https://github.com/cirruslabs/gitlab-tart-executor/issues/47
-		_, err := os.Stat(TartCommandHomebrewPath)
-		if err == nil {
-			return TartCommandHomebrewPath, nil
-		}
-
-		return "", fmt.Errorf("%w: %s command not found in PATH, make sure Tart is installed",
-			ErrTartNotFound, TartCommandName)
-	}
-
-	return result, nil
+// TartRunPIDPath is similar to TartRunOutputPath, but
+// contains the PID of the process running the VM.
+func (vm *VM) TartRunPIDPath() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("%s-tart-run.pid", vm.id))
 }
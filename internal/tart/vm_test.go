@@ -0,0 +1,183 @@
+package tart_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/cirruslabs/gitlab-tart-executor/internal/gitlab"
+	"github.com/cirruslabs/gitlab-tart-executor/internal/tart"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestVMLifecycleWithFakeBackend(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+	gitLabEnv := gitlab.Env{JobID: "42"}
+
+	config, err := tart.NewConfigFromEnvironment()
+	require.NoError(t, err)
+
+	vm, err := tart.CreateNewVM(ctx, backend, gitLabEnv.VirtualMachineID(),
+		"ghcr.io/cirruslabs/macos-sonoma-base:latest", config, 4, 8192, nil)
+	require.NoError(t, err)
+
+	fakeVM, ok := backend.VM("gitlab-42")
+	require.True(t, ok)
+	require.Equal(t, "ghcr.io/cirruslabs/macos-sonoma-base:latest", fakeVM.Source)
+	require.EqualValues(t, 4, fakeVM.CPU)
+	require.EqualValues(t, 8192, fakeVM.Memory)
+	require.True(t, fakeVM.RandomMAC)
+	require.False(t, fakeVM.Running)
+
+	require.NoError(t, vm.Start(ctx, config, &gitLabEnv, nil, nil, true, nil))
+
+	fakeVM, ok = backend.VM("gitlab-42")
+	require.True(t, ok)
+	require.True(t, fakeVM.Running)
+	require.Equal(t, []string{"--no-graphics", "--nested"}, fakeVM.RunArgs)
+
+	// Subsequent stages refer to the VM by the job ID
+	existingVM := tart.ExistingVM(backend, gitLabEnv)
+
+	ip, err := existingVM.IP(ctx, config)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", ip)
+
+	vmInfo, err := existingVM.Info(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "darwin", vmInfo.OS)
+
+	require.NoError(t, existingVM.Stop())
+	require.NoError(t, existingVM.Delete())
+
+	_, ok = backend.VM("gitlab-42")
+	require.False(t, ok)
+
+	require.ErrorIs(t, existingVM.Delete(), tart.ErrVMFailed)
+}
+
+func TestCreateNewVMDiskSize(t *testing.T) {
+	t.Setenv("CUSTOM_ENV_TART_EXECUTOR_DISK_SIZE", "100")
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+
+	config, err := tart.NewConfigFromEnvironment()
+	require.NoError(t, err)
+	require.EqualValues(t, 100, config.DiskSize)
+
+	_, err = tart.CreateNewVM(ctx, backend, "gitlab-42", "ghcr.io/cirruslabs/macos-sonoma-base:latest",
+		config, 0, 0, nil)
+	require.NoError(t, err)
+
+	fakeVM, ok := backend.VM("gitlab-42")
+	require.True(t, ok)
+	require.EqualValues(t, 100, fakeVM.DiskSize)
+}
+
+func TestCreateNewVMDiskSizeSmallerThanImage(t *testing.T) {
+	t.Setenv("CUSTOM_ENV_TART_EXECUTOR_DISK_SIZE", "50")
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+	backend.DiskSize = 80
+
+	config, err := tart.NewConfigFromEnvironment()
+	require.NoError(t, err)
+
+	// The disk can only be grown, so the image's disk is kept as is
+	_, err = tart.CreateNewVM(ctx, backend, "gitlab-42", "ghcr.io/cirruslabs/macos-sonoma-base:latest",
+		config, 0, 0, nil)
+	require.NoError(t, err)
+
+	fakeVM, ok := backend.VM("gitlab-42")
+	require.True(t, ok)
+	require.EqualValues(t, 80, fakeVM.DiskSize)
+}
+
+func TestOpenSSHBootTimeout(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+
+	config, err := tart.NewConfigFromEnvironment()
+	require.NoError(t, err)
+
+	config.SetDefaultTimeouts(time.Second, 100*time.Millisecond, 50*time.Millisecond)
+
+	// The VM never gets an IP address because it's not running
+	vm, err := tart.CreateNewVM(ctx, backend, "gitlab-42",
+		"ghcr.io/cirruslabs/macos-sonoma-base:latest", config, 0, 0, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(vm.TartRunOutputPath(),
+		[]byte("Booting...\nKernel panic!\n"), 0600))
+
+	_, err = vm.OpenSSH(ctx, config, &net.Dialer{}, ssh.InsecureIgnoreHostKey()) //nolint:gosec // not needed here
+	require.ErrorIs(t, err, tart.ErrBootTimeout)
+	require.ErrorContains(t, err, "Kernel panic!")
+}
+
+func TestOpenSSHBootTimeoutOnly(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+
+	config, err := tart.NewConfigFromEnvironment()
+	require.NoError(t, err)
+
+	// Far more IP address retrieval attempts than retry-go does by default
+	config.SetDefaultTimeouts(time.Second, 500*time.Millisecond, 10*time.Millisecond)
+
+	vm, err := tart.CreateNewVM(ctx, backend, "gitlab-42",
+		"ghcr.io/cirruslabs/macos-sonoma-base:latest", config, 0, 0, nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+
+	_, err = vm.OpenSSH(ctx, config, &net.Dialer{}, ssh.InsecureIgnoreHostKey()) //nolint:gosec // not needed here
+	require.ErrorIs(t, err, tart.ErrBootTimeout)
+	require.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestOpenSSHVMExited(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	ctx := context.Background()
+	backend := tart.NewFakeBackend()
+
+	config, err := tart.NewConfigFromEnvironment()
+	require.NoError(t, err)
+
+	// Nothing listens there, so the SSH connection is re-tried
+	config.SSHPort = 1
+
+	vm, err := tart.CreateNewVM(ctx, backend, "gitlab-42",
+		"ghcr.io/cirruslabs/macos-sonoma-base:latest", config, 0, 0, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, vm.Start(ctx, config, &gitlab.Env{JobID: "42"}, nil, nil, false, nil))
+
+	// Pretend that "tart run" has exited
+	exitedCmd := exec.Command("true")
+	require.NoError(t, exitedCmd.Run())
+
+	require.NoError(t, os.WriteFile(vm.TartRunPIDPath(),
+		fmt.Appendf(nil, "%d\n", exitedCmd.Process.Pid), 0600))
+	require.NoError(t, os.WriteFile(vm.TartRunOutputPath(),
+		[]byte("Error: the specified disk is already in use\n"), 0600))
+
+	_, err = vm.OpenSSH(ctx, config, &net.Dialer{}, ssh.InsecureIgnoreHostKey()) //nolint:gosec // not needed here
+	require.ErrorIs(t, err, tart.ErrVMExited)
+	require.ErrorContains(t, err, "the specified disk is already in use")
+}